@@ -10,9 +10,14 @@ import (
 	"github.com/algm/go-netdicom/dimse"
 	"github.com/algm/go-netdicom/sopclass"
 	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomio"
 	"github.com/stretchr/testify/require"
 )
 
+// testdata/IM-0001-0003.dcm is JPEG 2000 compressed. It cannot be converted
+// to another transfer syntax, so clients that send it propose its own.
+var testTransferSyntaxes = append([]string{"1.2.840.10008.1.2.4.91"}, dicomio.StandardTransferSyntaxes...)
+
 // Simple C-STORE handler for testing
 func testCStoreHandler(
 	ctx context.Context,
@@ -72,7 +77,7 @@ func TestStoreWithContext(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 
 	// Create client and connect to the test server
-	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.StorageClasses})
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.StorageClasses, TransferSyntaxes: testTransferSyntaxes})
 	require.NoError(t, err)
 	defer su.Release()
 
@@ -166,7 +171,7 @@ func TestContextCancellationInHandler(t *testing.T) {
 	time.Sleep(50 * time.Millisecond)
 
 	// Try to connect to server (should fail or be rejected)
-	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.StorageClasses})
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.StorageClasses, TransferSyntaxes: testTransferSyntaxes})
 	require.NoError(t, err)
 	defer su.Release()
 
@@ -201,7 +206,7 @@ func TestRunForeverBackwardCompatibility(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 
 	// Create client and test basic functionality
-	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.StorageClasses})
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.StorageClasses, TransferSyntaxes: testTransferSyntaxes})
 	require.NoError(t, err)
 	defer su.Release()
 
@@ -2,8 +2,11 @@ package netdicom
 
 import (
 	"fmt"
+	"math"
+	"sort"
 
 	"github.com/algm/go-netdicom/pdu/pdu_item"
+	"github.com/algm/go-netdicom/sopclass"
 	"github.com/grailbio/go-dicom"
 	"github.com/grailbio/go-dicom/dicomlog"
 	"github.com/grailbio/go-dicom/dicomuid"
@@ -27,18 +30,48 @@ type contextManagerEntry struct {
 type contextManager struct {
 	label string // for diagnostics only.
 
-	// The two maps are inverses of each other.
+	// The two maps are inverses of each other. An abstract syntax may be
+	// proposed in multiple contexts, typically one per transfer syntax, so
+	// abstractSyntaxNameToContextIDMap lists all of them in the order they
+	// were added.
 	contextIDToAbstractSyntaxNameMap map[byte]*contextManagerEntry
-	abstractSyntaxNameToContextIDMap map[string]*contextManagerEntry
+	abstractSyntaxNameToContextIDMap map[string][]*contextManagerEntry
+
+	// AE titles from A-ASSOCIATE-RQ, stripped of their space padding.
+	callingAETitle string
+	calledAETitle  string
 
 	// Info about the the other side of the communication, gleaned from
 	// A-ASSOCIATE-* pdu.
+	// Zero means the peer accepts PDUs of any size.
 	peerMaxPDUSize int
 	// UID that identifies the peer type. It's supposed to be globally unique.
 	peerImplementationClassUID string
 	// Implementation version, virtually meaningless since its format isn't standardiszed.
 	peerImplementationVersionName string
 
+	// SOP classes for which the association requestor (client) may act as
+	// an SCP, as agreed through SCP/SCU role selection negotiation. The
+	// provider may issue C-STORE sub-operations of C-GET only for these
+	// classes.
+	requestorSCPRoles map[string]bool
+
+	// The acceptor's answer to the requestor's user identity (P3.7
+	// D.3.3.7). Nil if the acceptor didn't send one.
+	userIdentityResponse *pdu_item.UserIdentityResponseSubItem
+
+	// Service-class application information agreed through SOP class
+	// extended negotiation (P3.7 D.3.3.5), keyed by SOP class UID. The
+	// values are the ones sent by the acceptor.
+	extendedNegotiation map[string][]byte
+
+	// Asynchronous operations window (P3.7 D.3.3.3) negotiated during the
+	// handshake, from the association requestor's point of view: the number
+	// of operations the requestor may invoke and perform concurrently. Zero
+	// means unlimited. Both are 1 unless negotiated otherwise.
+	maxOpsInvoked   int
+	maxOpsPerformed int
+
 	// tmpRequests used only on the client (requestor) side. It holds the
 	// contextid->presentationcontext mapping generated from the
 	// A_ASSOCIATE_RQ PDU. Once an A_ASSOCIATE_AC PDU arrives, tmpRequests
@@ -52,25 +85,45 @@ func newContextManager(label string) *contextManager {
 	c := &contextManager{
 		label:                            label,
 		contextIDToAbstractSyntaxNameMap: make(map[byte]*contextManagerEntry),
-		abstractSyntaxNameToContextIDMap: make(map[string]*contextManagerEntry),
+		abstractSyntaxNameToContextIDMap: make(map[string][]*contextManagerEntry),
+		requestorSCPRoles:                make(map[string]bool),
+		extendedNegotiation:              make(map[string][]byte),
+		maxOpsInvoked:                    1,
+		maxOpsPerformed:                  1,
 		peerMaxPDUSize:                   16384, // The default value used by Osirix & pynetdicom.
 		tmpRequests:                      make(map[byte]*pdu_item.PresentationContextItem),
 	}
 	return c
 }
 
+// Return the accepted presentation contexts, ordered by context ID.
+func (m *contextManager) acceptedPresentationContexts() []PresentationContext {
+	var contexts []PresentationContext
+	for _, e := range m.contextIDToAbstractSyntaxNameMap {
+		if e.result != pdu_item.PresentationContextAccepted {
+			continue
+		}
+		contexts = append(contexts, PresentationContext{
+			ID:                e.contextID,
+			AbstractSyntaxUID: e.abstractSyntaxUID,
+			TransferSyntaxUID: e.transferSyntaxUID,
+		})
+	}
+	sort.Slice(contexts, func(i, j int) bool { return contexts[i].ID < contexts[j].ID })
+	return contexts
+}
+
 // Called by the user (client) to produce a list to be embedded in an
 // A_REQUEST_RQ.Items. The PDU is sent when running as a service user (client).
-// maxPDUSize is the maximum PDU size, in bytes, that the clients is willing to
-// receive. maxPDUSize is encoded in one of the items.
-func (m *contextManager) generateAssociateRequest(
-	sopClassUIDs []string, transferSyntaxUIDs []string) []pdu_item.SubItem {
+func (m *contextManager) generateAssociateRequest(params *ServiceUserParams) []pdu_item.SubItem {
+	sopClassUIDs := params.SOPClasses
+	transferSyntaxUIDs := params.TransferSyntaxes
 	items := []pdu_item.SubItem{
 		&pdu_item.ApplicationContextItem{
 			Name: pdu_item.DICOMApplicationContextItemName,
 		}}
 	var contextID byte = 1
-	for _, sop := range sopClassUIDs {
+	addContext := func(sop string, transferSyntaxUIDs []string) {
 		syntaxItems := []pdu_item.SubItem{
 			&pdu_item.AbstractSyntaxSubItem{Name: sop},
 		}
@@ -87,24 +140,74 @@ func (m *contextManager) generateAssociateRequest(
 		m.tmpRequests[contextID] = item
 		contextID += 2 // must be odd.
 	}
-	items = append(items,
-		&pdu_item.UserInformationItem{
-			Items: []pdu_item.SubItem{
-				&pdu_item.UserInformationMaximumLengthItem{uint32(DefaultMaxPDUSize)},
-				&pdu_item.ImplementationClassUIDSubItem{dicom.GoDICOMImplementationClassUID},
-				&pdu_item.ImplementationVersionNameSubItem{dicom.GoDICOMImplementationVersionName}}})
+	for _, sop := range sopClassUIDs {
+		if params.ContextPerTransferSyntax {
+			for _, syntaxUID := range transferSyntaxUIDs {
+				addContext(sop, []string{syntaxUID})
+			}
+		} else {
+			addContext(sop, transferSyntaxUIDs)
+		}
+	}
+	userItems := []pdu_item.SubItem{
+		&pdu_item.UserInformationMaximumLengthItem{MaximumLengthReceived: advertisedPDUSize(params.MaxPDUSize)},
+		&pdu_item.ImplementationClassUIDSubItem{Name: dicom.GoDICOMImplementationClassUID},
+		&pdu_item.ImplementationVersionNameSubItem{Name: dicom.GoDICOMImplementationVersionName}}
+	if params.UserIdentity != nil {
+		userItems = append(userItems, params.UserIdentity)
+	}
+	for _, item := range params.SOPClassExtendedNegotiation {
+		userItems = append(userItems, item)
+	}
+	for _, item := range params.SOPClassCommonExtendedNegotiation {
+		userItems = append(userItems, item)
+	}
+	if params.MaxOpsInvoked > 1 {
+		userItems = append(userItems, &pdu_item.AsynchronousOperationsWindowSubItem{
+			MaxOpsInvoked:   uint16(params.MaxOpsInvoked),
+			MaxOpsPerformed: 1,
+		})
+	}
+	userItems = append(userItems, generateRoleSelectionItems(sopClassUIDs)...)
+	items = append(items, &pdu_item.UserInformationItem{Items: userItems})
+	return items
+}
 
+// If the client proposes a C-GET SOP class, the storage classes it proposes
+// are to be used for the C-STORE sub-operations, for which the client acts as
+// an SCP. Propose the SCP role for them (P3.4 C.4.3.1), keeping the SCU role so
+// that the client can still issue regular C-STOREs.
+func generateRoleSelectionItems(sopClassUIDs []string) []pdu_item.SubItem {
+	hasCGet := false
+	for _, sop := range sopClassUIDs {
+		if containsUID(sopclass.QRGetClasses, sop) && !containsUID(sopclass.StorageClasses, sop) {
+			hasCGet = true
+			break
+		}
+	}
+	if !hasCGet {
+		return nil
+	}
+	var items []pdu_item.SubItem
+	for _, sop := range sopClassUIDs {
+		if containsUID(sopclass.StorageClasses, sop) {
+			items = append(items, &pdu_item.RoleSelectionSubItem{SOPClassUID: sop, SCURole: 1, SCPRole: 1})
+		}
+	}
 	return items
 }
 
 // Called when A_ASSOCIATE_RQ pdu arrives, on the provider side. Returns a list of items to be sent in
-// the A_ASSOCIATE_AC pdu.
-func (m *contextManager) onAssociateRequest(requestItems []pdu_item.SubItem) ([]pdu_item.SubItem, error) {
+// the A_ASSOCIATE_AC pdu. params decides which of the proposed presentation
+// contexts are accepted.
+func (m *contextManager) onAssociateRequest(params *ServiceProviderParams, requestItems []pdu_item.SubItem) ([]pdu_item.SubItem, error) {
 	responses := []pdu_item.SubItem{
 		&pdu_item.ApplicationContextItem{
 			Name: pdu_item.DICOMApplicationContextItemName,
 		},
 	}
+	var userResponses []pdu_item.SubItem
+	var extendedNegotiationRequests []*pdu_item.SOPClassExtendedNegotiationSubItem
 	for _, requestItem := range requestItems {
 		switch ri := requestItem.(type) {
 		case *pdu_item.ApplicationContextItem:
@@ -114,7 +217,7 @@ func (m *contextManager) onAssociateRequest(requestItems []pdu_item.SubItem) ([]
 			}
 		case *pdu_item.PresentationContextItem:
 			var sopUID string
-			var pickedTransferSyntaxUID string
+			var transferSyntaxUIDs []string
 			for _, subItem := range ri.Items {
 				switch c := subItem.(type) {
 				case *pdu_item.AbstractSyntaxSubItem:
@@ -124,28 +227,31 @@ func (m *contextManager) onAssociateRequest(requestItems []pdu_item.SubItem) ([]
 					}
 					sopUID = c.Name
 				case *pdu_item.TransferSyntaxSubItem:
-					// Just pick the first syntax UID proposed by the client.
-					if pickedTransferSyntaxUID == "" {
-						pickedTransferSyntaxUID = c.Name
-					}
+					transferSyntaxUIDs = append(transferSyntaxUIDs, c.Name)
 				default:
 					return nil, fmt.Errorf("dicom.onAssociateRequest: Unknown subitem in PresentationContext: %s",
 						subItem.String())
 				}
 			}
-			if sopUID == "" || pickedTransferSyntaxUID == "" {
+			if sopUID == "" || len(transferSyntaxUIDs) == 0 {
 				return nil, fmt.Errorf("dicom.onAssociateRequest: SOP or transfersyntax not found in PresentationContext: %v",
 					ri.String())
 			}
+			pickedTransferSyntaxUID, result := pickTransferSyntax(params, sopUID, transferSyntaxUIDs)
 			responses = append(responses, &pdu_item.PresentationContextItem{
 				Type:      pdu_item.ItemTypePresentationContextResponse,
 				ContextID: ri.ContextID,
-				Result:    0, // accepted
+				Result:    result,
 				Items:     []pdu_item.SubItem{&pdu_item.TransferSyntaxSubItem{Name: pickedTransferSyntaxUID}}})
+			if result != pdu_item.PresentationContextAccepted {
+				dicomlog.Vprintf(0, "dicom.onAssociateRequest(%s): Rejecting abstract syntax %v, transfer syntaxes %v: %s",
+					m.label, dicomuid.UIDString(sopUID), transferSyntaxUIDs, result.String())
+			}
 			dicomlog.Vprintf(2, "dicom.onAssociateRequest(%s): Provider(%p): addmapping %v %v %v",
 				m.label, m, sopUID, pickedTransferSyntaxUID, ri.ContextID)
-			// TODO(saito) Callback the service provider instead of accepting the sopclass blindly.
-			addContextMapping(m, sopUID, pickedTransferSyntaxUID, ri.ContextID, pdu_item.PresentationContextAccepted)
+			if err := addContextMapping(m, sopUID, pickedTransferSyntaxUID, ri.ContextID, result); err != nil {
+				return nil, err
+			}
 		case *pdu_item.UserInformationItem:
 			for _, subItem := range ri.Items {
 				switch c := subItem.(type) {
@@ -155,14 +261,53 @@ func (m *contextManager) onAssociateRequest(requestItems []pdu_item.SubItem) ([]
 					m.peerImplementationClassUID = c.Name
 				case *pdu_item.ImplementationVersionNameSubItem:
 					m.peerImplementationVersionName = c.Name
-
+				case *pdu_item.RoleSelectionSubItem:
+					if len(params.SupportedSOPClasses) > 0 && !containsUID(params.SupportedSOPClasses, c.SOPClassUID) {
+						// Not answering means the default roles.
+						continue
+					}
+					// Grant whatever roles the requestor asked for.
+					userResponses = append(userResponses, &pdu_item.RoleSelectionSubItem{
+						SOPClassUID: c.SOPClassUID,
+						SCURole:     c.SCURole,
+						SCPRole:     c.SCPRole,
+					})
+					if c.SCPRole == 1 {
+						m.requestorSCPRoles[c.SOPClassUID] = true
+					}
+				case *pdu_item.AsynchronousOperationsWindowSubItem:
+					// We don't invoke operations asynchronously, so the
+					// requestor needs to perform only one at a time.
+					m.maxOpsInvoked = negotiateOpsWindow(c.MaxOpsInvoked, params.MaxOpsPerformed)
+					m.maxOpsPerformed = 1
+					userResponses = append(userResponses, &pdu_item.AsynchronousOperationsWindowSubItem{
+						MaxOpsInvoked:   uint16(m.maxOpsInvoked),
+						MaxOpsPerformed: uint16(m.maxOpsPerformed),
+					})
+				case *pdu_item.SOPClassExtendedNegotiationSubItem:
+					// Answered after all the presentation contexts are
+					// known.
+					extendedNegotiationRequests = append(extendedNegotiationRequests, c)
 				}
 			}
 		}
 	}
+	for _, c := range extendedNegotiationRequests {
+		if info := m.negotiateExtended(params, c); info != nil {
+			userResponses = append(userResponses, &pdu_item.SOPClassExtendedNegotiationSubItem{
+				SOPClassUID:                        c.SOPClassUID,
+				ServiceClassApplicationInformation: info,
+			})
+		}
+	}
+	if m.userIdentityResponse != nil {
+		userResponses = append(userResponses, m.userIdentityResponse)
+	}
 	responses = append(responses,
 		&pdu_item.UserInformationItem{
-			Items: []pdu_item.SubItem{&pdu_item.UserInformationMaximumLengthItem{MaximumLengthReceived: uint32(DefaultMaxPDUSize)}}})
+			Items: append([]pdu_item.SubItem{
+				&pdu_item.UserInformationMaximumLengthItem{MaximumLengthReceived: advertisedPDUSize(params.MaxPDUSize)}},
+				userResponses...)})
 	dicomlog.Vprintf(1, "dicom.onAssociateRequest(%s): Received associate request, #contexts:%v, maxPDU:%v, implclass:%v, version:%v",
 		m.label, len(m.contextIDToAbstractSyntaxNameMap),
 		m.peerMaxPDUSize, m.peerImplementationClassUID, m.peerImplementationVersionName)
@@ -227,7 +372,9 @@ func (m *contextManager) onAssociateResponse(responses []pdu_item.SubItem) error
 					dicomuid.UIDString(sopUID),
 					request.Items)
 			}
-			addContextMapping(m, sopUID, pickedTransferSyntaxUID, ri.ContextID, ri.Result)
+			if err := addContextMapping(m, sopUID, pickedTransferSyntaxUID, ri.ContextID, ri.Result); err != nil {
+				return err
+			}
 		case *pdu_item.UserInformationItem:
 			for _, subItem := range ri.Items {
 				switch c := subItem.(type) {
@@ -237,7 +384,17 @@ func (m *contextManager) onAssociateResponse(responses []pdu_item.SubItem) error
 					m.peerImplementationClassUID = c.Name
 				case *pdu_item.ImplementationVersionNameSubItem:
 					m.peerImplementationVersionName = c.Name
-
+				case *pdu_item.RoleSelectionSubItem:
+					if c.SCPRole == 1 {
+						m.requestorSCPRoles[c.SOPClassUID] = true
+					}
+				case *pdu_item.AsynchronousOperationsWindowSubItem:
+					m.maxOpsInvoked = int(c.MaxOpsInvoked)
+					m.maxOpsPerformed = int(c.MaxOpsPerformed)
+				case *pdu_item.UserIdentityResponseSubItem:
+					m.userIdentityResponse = c
+				case *pdu_item.SOPClassExtendedNegotiationSubItem:
+					m.extendedNegotiation[c.SOPClassUID] = c.ServiceClassApplicationInformation
 				}
 			}
 		}
@@ -249,21 +406,96 @@ func (m *contextManager) onAssociateResponse(responses []pdu_item.SubItem) error
 	return nil
 }
 
-// Add a mapping between a (global) UID and a (per-session) context ID.
+// pickTransferSyntax decides whether the provider accepts a presentation
+// context for abstract syntax sopUID, for which the requestor proposed
+// transferSyntaxUIDs (in the requestor's order of preference). Among the
+// acceptable proposals, the one ranked highest in
+// params.PreferredTransferSyntaxes wins. It returns the transfer syntax to use
+// and the result to be reported in A-ASSOCIATE-AC. For a rejected context, the
+// returned transfer syntax is merely informational.
+func pickTransferSyntax(params *ServiceProviderParams, sopUID string, transferSyntaxUIDs []string) (string, pdu_item.PresentationContextResult) {
+	if len(params.SupportedSOPClasses) > 0 && !containsUID(params.SupportedSOPClasses, sopUID) {
+		return transferSyntaxUIDs[0], pdu_item.PresentationContextProviderRejectionAbstractSyntaxNotSupported
+	}
+	var candidates []string
+	for _, uid := range transferSyntaxUIDs {
+		if len(params.SupportedTransferSyntaxes) == 0 || containsUID(params.SupportedTransferSyntaxes, uid) {
+			candidates = append(candidates, uid)
+		}
+	}
+	if len(candidates) == 0 {
+		return transferSyntaxUIDs[0], pdu_item.PresentationContextProviderRejectionTransferSyntaxNotSupported
+	}
+	for _, uid := range params.PreferredTransferSyntaxes {
+		if containsUID(candidates, uid) {
+			return uid, pdu_item.PresentationContextAccepted
+		}
+	}
+	return candidates[0], pdu_item.PresentationContextAccepted
+}
+
+// Decide the provider's answer to a SOP class extended negotiation proposal.
+// Returns nil if the provider doesn't answer, in which case the requestor must
+// assume that none of the proposed features is supported.
+func (m *contextManager) negotiateExtended(params *ServiceProviderParams, c *pdu_item.SOPClassExtendedNegotiationSubItem) []byte {
+	if params.OnExtendedNegotiation == nil {
+		return nil
+	}
+	// Extended negotiation applies only to accepted SOP classes.
+	if _, err := m.lookupByAbstractSyntaxUID(c.SOPClassUID); err != nil {
+		return nil
+	}
+	info := params.OnExtendedNegotiation(c.SOPClassUID, c.ServiceClassApplicationInformation)
+	if info != nil {
+		m.extendedNegotiation[c.SOPClassUID] = info
+	}
+	return info
+}
+
+// Compute the number of operations the requestor may invoke, given its proposal
+// (zero means unlimited) and the number of operations the provider is willing
+// to perform.
+func negotiateOpsWindow(proposed uint16, maxOpsPerformed int) int {
+	if maxOpsPerformed <= 1 {
+		return 1
+	}
+	if maxOpsPerformed > math.MaxUint16 {
+		maxOpsPerformed = math.MaxUint16
+	}
+	if proposed == 0 || int(proposed) > maxOpsPerformed {
+		return maxOpsPerformed
+	}
+	return int(proposed)
+}
+
+func containsUID(uids []string, uid string) bool {
+	for _, u := range uids {
+		if u == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// Add a mapping between a (global) UID and a (per-session) context ID. The
+// args come from the peer, so they are validated.
 func addContextMapping(
 	m *contextManager,
 	abstractSyntaxUID string,
 	transferSyntaxUID string,
 	contextID byte,
-	result pdu_item.PresentationContextResult) {
+	result pdu_item.PresentationContextResult) error {
 	dicomlog.Vprintf(2, "dicom.addContextMapping(%v): Map context %d -> %s, %s",
 		m.label, contextID, dicomuid.UIDString(abstractSyntaxUID),
 		dicomuid.UIDString(transferSyntaxUID))
-	doassert(result >= 0 && result <= 4, result)
-	doassert(contextID%2 == 1, contextID)
-	if result == 0 {
-		doassert(abstractSyntaxUID != "", abstractSyntaxUID)
-		doassert(transferSyntaxUID != "", transferSyntaxUID)
+	if result > 4 {
+		return fmt.Errorf("dicom.addContextMapping(%v): invalid result %d for context %d", m.label, result, contextID)
+	}
+	if contextID%2 != 1 {
+		return fmt.Errorf("dicom.addContextMapping(%v): context ID %d must be odd", m.label, contextID)
+	}
+	if result == pdu_item.PresentationContextAccepted && (abstractSyntaxUID == "" || transferSyntaxUID == "") {
+		return fmt.Errorf("dicom.addContextMapping(%v): context %d accepted without an abstract or transfer syntax", m.label, contextID)
 	}
 	e := &contextManagerEntry{
 		abstractSyntaxUID: abstractSyntaxUID,
@@ -272,7 +504,14 @@ func addContextMapping(
 		result:            result,
 	}
 	m.contextIDToAbstractSyntaxNameMap[contextID] = e
-	m.abstractSyntaxNameToContextIDMap[abstractSyntaxUID] = e
+	m.abstractSyntaxNameToContextIDMap[abstractSyntaxUID] = append(m.abstractSyntaxNameToContextIDMap[abstractSyntaxUID], e)
+	return nil
+}
+
+// Reports whether the association requestor has been granted the SCP role for
+// the given SOP class.
+func (m *contextManager) isRequestorSCP(sopClassUID string) bool {
+	return m.requestorSCPRoles[sopClassUID]
 }
 
 func (m *contextManager) checkContextRejection(e *contextManagerEntry) error {
@@ -286,17 +525,36 @@ func (m *contextManager) checkContextRejection(e *contextManagerEntry) error {
 	return nil
 }
 
-// Convert an UID to a context ID.
+// Convert an UID to a context ID. If the abstract syntax was accepted in
+// multiple contexts, the first one is returned.
 func (m *contextManager) lookupByAbstractSyntaxUID(name string) (contextManagerEntry, error) {
-	e, ok := m.abstractSyntaxNameToContextIDMap[name]
+	return m.lookupByAbstractSyntaxAndTransferSyntaxUID(name, "")
+}
+
+// Convert an UID to a context ID, preferring the context accepted with the
+// given transfer syntax. If there is no such context, the first accepted
+// context for the abstract syntax is returned.
+func (m *contextManager) lookupByAbstractSyntaxAndTransferSyntaxUID(name string, transferSyntaxUID string) (contextManagerEntry, error) {
+	entries, ok := m.abstractSyntaxNameToContextIDMap[name]
 	if !ok {
 		return contextManagerEntry{}, fmt.Errorf("dicom.checkContextRejection %v: Unknown syntax %s", m.label, dicomuid.UIDString(name))
 	}
-	err := m.checkContextRejection(e)
-	if err != nil {
-		return contextManagerEntry{}, err
+	var accepted *contextManagerEntry
+	for _, e := range entries {
+		if e.result != pdu_item.PresentationContextAccepted {
+			continue
+		}
+		if e.transferSyntaxUID == transferSyntaxUID {
+			return *e, nil
+		}
+		if accepted == nil {
+			accepted = e
+		}
 	}
-	return *e, nil
+	if accepted == nil {
+		return contextManagerEntry{}, m.checkContextRejection(entries[0])
+	}
+	return *accepted, nil
 }
 
 // Convert a contextID to a UID.
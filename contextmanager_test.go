@@ -0,0 +1,362 @@
+package netdicom
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/algm/go-netdicom/pdu"
+	"github.com/algm/go-netdicom/pdu/pdu_item"
+	"github.com/algm/go-netdicom/sopclass"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/stretchr/testify/require"
+)
+
+func newPresentationContextRequest(contextID byte, sopUID string, transferSyntaxUIDs ...string) *pdu_item.PresentationContextItem {
+	items := []pdu_item.SubItem{&pdu_item.AbstractSyntaxSubItem{Name: sopUID}}
+	for _, uid := range transferSyntaxUIDs {
+		items = append(items, &pdu_item.TransferSyntaxSubItem{Name: uid})
+	}
+	return &pdu_item.PresentationContextItem{
+		Type:      pdu_item.ItemTypePresentationContextRequest,
+		ContextID: contextID,
+		Items:     items,
+	}
+}
+
+// Find the response for the given context ID in an A-ASSOCIATE-AC item list.
+func findPresentationContextResponse(t *testing.T, items []pdu_item.SubItem, contextID byte) *pdu_item.PresentationContextItem {
+	for _, item := range items {
+		if pc, ok := item.(*pdu_item.PresentationContextItem); ok && pc.ContextID == contextID {
+			return pc
+		}
+	}
+	t.Fatalf("No response for context %d in %v", contextID, pdu_item.SubItemListString(items))
+	return nil
+}
+
+func responseTransferSyntax(pc *pdu_item.PresentationContextItem) string {
+	for _, item := range pc.Items {
+		if ts, ok := item.(*pdu_item.TransferSyntaxSubItem); ok {
+			return ts.Name
+		}
+	}
+	return ""
+}
+
+func TestOnAssociateRequestAcceptsAllByDefault(t *testing.T) {
+	cm := newContextManager("test")
+	responses, err := cm.onAssociateRequest(&ServiceProviderParams{}, []pdu_item.SubItem{
+		newPresentationContextRequest(1, dicomuid.VerificationSOPClass,
+			dicomuid.ImplicitVRLittleEndian, dicomuid.ExplicitVRLittleEndian),
+	})
+	require.NoError(t, err)
+	pc := findPresentationContextResponse(t, responses, 1)
+	require.Equal(t, pdu_item.PresentationContextAccepted, pc.Result)
+	require.Equal(t, dicomuid.ImplicitVRLittleEndian, responseTransferSyntax(pc))
+}
+
+func TestOnAssociateRequestPolicy(t *testing.T) {
+	params := &ServiceProviderParams{
+		SupportedSOPClasses:       []string{dicomuid.VerificationSOPClass, dicomuid.StudyRootQRFind},
+		SupportedTransferSyntaxes: []string{dicomuid.ExplicitVRLittleEndian},
+	}
+	cm := newContextManager("test")
+	responses, err := cm.onAssociateRequest(params, []pdu_item.SubItem{
+		newPresentationContextRequest(1, dicomuid.VerificationSOPClass,
+			dicomuid.ImplicitVRLittleEndian, dicomuid.ExplicitVRLittleEndian),
+		newPresentationContextRequest(3, dicomuid.PatientRootQRFind, dicomuid.ExplicitVRLittleEndian),
+		newPresentationContextRequest(5, dicomuid.StudyRootQRFind, dicomuid.ImplicitVRLittleEndian),
+	})
+	require.NoError(t, err)
+
+	pc := findPresentationContextResponse(t, responses, 1)
+	require.Equal(t, pdu_item.PresentationContextAccepted, pc.Result)
+	require.Equal(t, dicomuid.ExplicitVRLittleEndian, responseTransferSyntax(pc))
+
+	pc = findPresentationContextResponse(t, responses, 3)
+	require.Equal(t, pdu_item.PresentationContextProviderRejectionAbstractSyntaxNotSupported, pc.Result)
+
+	pc = findPresentationContextResponse(t, responses, 5)
+	require.Equal(t, pdu_item.PresentationContextProviderRejectionTransferSyntaxNotSupported, pc.Result)
+
+	_, err = cm.lookupByAbstractSyntaxUID(dicomuid.VerificationSOPClass)
+	require.NoError(t, err)
+	_, err = cm.lookupByAbstractSyntaxUID(dicomuid.PatientRootQRFind)
+	require.Error(t, err)
+	_, err = cm.lookupByContextID(5)
+	require.Error(t, err)
+}
+
+func TestOnAssociateRequestPreferredTransferSyntax(t *testing.T) {
+	params := &ServiceProviderParams{
+		SupportedTransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian, dicomuid.ExplicitVRLittleEndian},
+		PreferredTransferSyntaxes: []string{
+			dicomuid.ExplicitVRLittleEndian,
+			dicomuid.ImplicitVRLittleEndian,
+			dicomuid.DeflatedExplicitVRLittleEndian,
+		},
+	}
+	cm := newContextManager("test")
+	responses, err := cm.onAssociateRequest(params, []pdu_item.SubItem{
+		newPresentationContextRequest(1, dicomuid.VerificationSOPClass,
+			dicomuid.ImplicitVRLittleEndian, dicomuid.DeflatedExplicitVRLittleEndian, dicomuid.ExplicitVRLittleEndian),
+		newPresentationContextRequest(3, dicomuid.StudyRootQRFind,
+			dicomuid.DeflatedExplicitVRLittleEndian, dicomuid.ImplicitVRLittleEndian),
+	})
+	require.NoError(t, err)
+
+	pc := findPresentationContextResponse(t, responses, 1)
+	require.Equal(t, pdu_item.PresentationContextAccepted, pc.Result)
+	require.Equal(t, dicomuid.ExplicitVRLittleEndian, responseTransferSyntax(pc))
+
+	// Deflate is preferred but not supported.
+	pc = findPresentationContextResponse(t, responses, 3)
+	require.Equal(t, pdu_item.PresentationContextAccepted, pc.Result)
+	require.Equal(t, dicomuid.ImplicitVRLittleEndian, responseTransferSyntax(pc))
+}
+
+func findRoleSelectionItems(items []pdu_item.SubItem) []*pdu_item.RoleSelectionSubItem {
+	var roles []*pdu_item.RoleSelectionSubItem
+	for _, item := range items {
+		if ui, ok := item.(*pdu_item.UserInformationItem); ok {
+			for _, subItem := range ui.Items {
+				if role, ok := subItem.(*pdu_item.RoleSelectionSubItem); ok {
+					roles = append(roles, role)
+				}
+			}
+		}
+	}
+	return roles
+}
+
+func TestRoleSelection(t *testing.T) {
+	transferSyntaxes := []string{dicomuid.ImplicitVRLittleEndian}
+
+	// No C-GET, no role selection.
+	user := newContextManager("user")
+	items := user.generateAssociateRequest(&ServiceUserParams{
+		SOPClasses: sopclass.StorageClasses, TransferSyntaxes: transferSyntaxes})
+	require.Empty(t, findRoleSelectionItems(items))
+
+	user = newContextManager("user")
+	items = user.generateAssociateRequest(&ServiceUserParams{
+		SOPClasses: sopclass.QRGetClasses, TransferSyntaxes: transferSyntaxes})
+	roles := findRoleSelectionItems(items)
+	require.Len(t, roles, len(sopclass.StorageClasses))
+	for _, role := range roles {
+		require.Equal(t, byte(1), role.SCPRole)
+	}
+
+	provider := newContextManager("provider")
+	require.False(t, provider.isRequestorSCP(ctImageStorage))
+	responses, err := provider.onAssociateRequest(&ServiceProviderParams{}, items)
+	require.NoError(t, err)
+	require.Len(t, findRoleSelectionItems(responses), len(sopclass.StorageClasses))
+	require.True(t, provider.isRequestorSCP(ctImageStorage))
+
+	require.NoError(t, user.onAssociateResponse(responses))
+	require.True(t, user.isRequestorSCP(ctImageStorage))
+
+	// The provider doesn't answer for unsupported SOP classes.
+	provider = newContextManager("provider")
+	responses, err = provider.onAssociateRequest(&ServiceProviderParams{
+		SupportedSOPClasses: []string{dicomuid.StudyRootQRGet},
+	}, items)
+	require.NoError(t, err)
+	require.Empty(t, findRoleSelectionItems(responses))
+	require.False(t, provider.isRequestorSCP(ctImageStorage))
+}
+
+const ctImageStorage = "1.2.840.10008.5.1.4.1.1.2"
+
+func TestAsynchronousOperationsWindow(t *testing.T) {
+	require.Equal(t, 1, negotiateOpsWindow(8, 0))
+	require.Equal(t, 4, negotiateOpsWindow(8, 4))
+	require.Equal(t, 4, negotiateOpsWindow(4, 8))
+	require.Equal(t, 8, negotiateOpsWindow(0, 8))
+
+	user := newContextManager("user")
+	items := user.generateAssociateRequest(&ServiceUserParams{
+		SOPClasses:       sopclass.StorageClasses,
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+		MaxOpsInvoked:    16,
+	})
+	provider := newContextManager("provider")
+	responses, err := provider.onAssociateRequest(&ServiceProviderParams{MaxOpsPerformed: 4}, items)
+	require.NoError(t, err)
+	require.Equal(t, 4, provider.maxOpsInvoked)
+	require.NoError(t, user.onAssociateResponse(responses))
+	require.Equal(t, 4, user.maxOpsInvoked)
+	require.Equal(t, 1, user.maxOpsPerformed)
+
+	// Without a proposal, the window stays at 1.
+	user = newContextManager("user")
+	items = user.generateAssociateRequest(&ServiceUserParams{
+		SOPClasses:       sopclass.StorageClasses,
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+	})
+	responses, err = newContextManager("provider").onAssociateRequest(&ServiceProviderParams{MaxOpsPerformed: 4}, items)
+	require.NoError(t, err)
+	require.NoError(t, user.onAssociateResponse(responses))
+	require.Equal(t, 1, user.maxOpsInvoked)
+}
+
+func TestExtendedNegotiation(t *testing.T) {
+	user := newContextManager("user")
+	userParams := &ServiceUserParams{
+		SOPClasses:       []string{dicomuid.StudyRootQRFind, dicomuid.PatientRootQRFind},
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+		SOPClassExtendedNegotiation: []*pdu_item.SOPClassExtendedNegotiationSubItem{
+			// Relational queries and fuzzy semantic matching.
+			{SOPClassUID: dicomuid.StudyRootQRFind, ServiceClassApplicationInformation: []byte{1, 0, 1}},
+			{SOPClassUID: dicomuid.PatientRootQRFind, ServiceClassApplicationInformation: []byte{1}},
+		},
+		SOPClassCommonExtendedNegotiation: []*pdu_item.SOPClassCommonExtendedNegotiationSubItem{{
+			SOPClassUID:                ctImageStorage,
+			ServiceClassUID:            "1.2.840.10008.4.2",
+			RelatedGeneralSOPClassUIDs: []string{"1.2.3", "1.2.3.4"},
+		}},
+	}
+	// Send the request through the wire format.
+	rqBytes, err := pdu.EncodePDU(&pdu.AAssociateRQ{
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   "SCP",
+		CallingAETitle:  "SCU",
+		Items:           user.generateAssociateRequest(userParams),
+	})
+	require.NoError(t, err)
+	rq, err := pdu.ReadPDU(bytes.NewReader(rqBytes), DefaultMaxPDUSize)
+	require.NoError(t, err)
+	items := rq.(*pdu.AAssociateRQ).Items
+
+	var common []*pdu_item.SOPClassCommonExtendedNegotiationSubItem
+	for _, item := range items {
+		if ui, ok := item.(*pdu_item.UserInformationItem); ok {
+			for _, subItem := range ui.Items {
+				if c, ok := subItem.(*pdu_item.SOPClassCommonExtendedNegotiationSubItem); ok {
+					common = append(common, c)
+				}
+			}
+		}
+	}
+	require.Equal(t, userParams.SOPClassCommonExtendedNegotiation, common)
+
+	provider := newContextManager("provider")
+	responses, err := provider.onAssociateRequest(&ServiceProviderParams{
+		SupportedSOPClasses: []string{dicomuid.StudyRootQRFind},
+		OnExtendedNegotiation: func(sopClassUID string, info []byte) []byte {
+			// Support relational queries only.
+			accepted := make([]byte, len(info))
+			accepted[0] = info[0]
+			return accepted
+		},
+	}, items)
+	require.NoError(t, err)
+	require.NoError(t, user.onAssociateResponse(responses))
+	require.Equal(t, []byte{1, 0, 0}, user.extendedNegotiation[dicomuid.StudyRootQRFind])
+	require.Equal(t, []byte{1, 0, 0}, provider.extendedNegotiation[dicomuid.StudyRootQRFind])
+	// The patient-root context was rejected, so its proposal is unanswered.
+	require.Nil(t, user.extendedNegotiation[dicomuid.PatientRootQRFind])
+}
+
+func TestContextPerTransferSyntax(t *testing.T) {
+	user := newContextManager("user")
+	items := user.generateAssociateRequest(&ServiceUserParams{
+		SOPClasses:               []string{ctImageStorage, dicomuid.VerificationSOPClass},
+		TransferSyntaxes:         []string{dicomuid.ExplicitVRLittleEndian, dicomuid.ImplicitVRLittleEndian, dicomuid.ExplicitVRBigEndian},
+		ContextPerTransferSyntax: true,
+	})
+	require.Len(t, extractPresentationContextItems(items), 6)
+	for _, pc := range extractPresentationContextItems(items) {
+		require.Len(t, pc.Items, 2) // abstract syntax + one transfer syntax
+	}
+
+	provider := newContextManager("provider")
+	responses, err := provider.onAssociateRequest(&ServiceProviderParams{
+		SupportedTransferSyntaxes: []string{dicomuid.ExplicitVRLittleEndian, dicomuid.ImplicitVRLittleEndian},
+	}, items)
+	require.NoError(t, err)
+	require.NoError(t, user.onAssociateResponse(responses))
+
+	for _, cm := range []*contextManager{user, provider} {
+		e, err := cm.lookupByAbstractSyntaxAndTransferSyntaxUID(ctImageStorage, dicomuid.ImplicitVRLittleEndian)
+		require.NoError(t, err)
+		require.Equal(t, dicomuid.ImplicitVRLittleEndian, e.transferSyntaxUID)
+		require.Equal(t, byte(3), e.contextID)
+
+		// Big endian was rejected; fall back to the first accepted context.
+		e, err = cm.lookupByAbstractSyntaxAndTransferSyntaxUID(ctImageStorage, dicomuid.ExplicitVRBigEndian)
+		require.NoError(t, err)
+		require.Equal(t, dicomuid.ExplicitVRLittleEndian, e.transferSyntaxUID)
+		require.Equal(t, byte(1), e.contextID)
+
+		_, err = cm.lookupByContextID(5)
+		require.Error(t, err)
+	}
+}
+
+func TestTooManyPresentationContexts(t *testing.T) {
+	_, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:               sopclass.StorageClasses,
+		TransferSyntaxes:         []string{dicomuid.ExplicitVRLittleEndian, dicomuid.ImplicitVRLittleEndian},
+		ContextPerTransferSyntax: true,
+	})
+	require.Error(t, err)
+}
+
+func TestTransferSyntaxesCanonicalized(t *testing.T) {
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.VerificationClasses,
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian + "\x00", dicomuid.ExplicitVRLittleEndian + " ", "1.2.840.10008.1.2.4.91"},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	require.Equal(t, []string{dicomuid.ImplicitVRLittleEndian, dicomuid.ExplicitVRLittleEndian, "1.2.840.10008.1.2.4.91"},
+		su.params.TransferSyntaxes)
+
+	_, err = NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.VerificationClasses,
+		TransferSyntaxes: []string{dicomuid.VerificationSOPClass},
+	})
+	require.Error(t, err)
+}
+
+func TestMaxPDUSize(t *testing.T) {
+	for _, test := range []struct {
+		userMaxPDUSize     int
+		providerMaxPDUSize int
+		maxSendPDUSize     int
+		wantSendPDUSize    int // by the user
+	}{
+		{0, 0, 0, DefaultMaxPDUSize},
+		{0, 16384, 0, 16384},
+		{0, 16384, 8192, 8192},
+		{0, 16384, 65536, 16384},
+		{0, UnlimitedPDUSize, 0, DefaultMaxPDUSize},
+		{0, UnlimitedPDUSize, 65536, 65536},
+	} {
+		userParams := ServiceUserParams{
+			SOPClasses:       []string{dicomuid.VerificationSOPClass},
+			TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+			MaxPDUSize:       test.userMaxPDUSize,
+			MaxSendPDUSize:   test.maxSendPDUSize,
+		}
+		providerParams := ServiceProviderParams{MaxPDUSize: test.providerMaxPDUSize}
+		user := &stateMachine{isUser: true, userParams: userParams, contextManager: newContextManager("user")}
+		provider := &stateMachine{providerParams: providerParams, contextManager: newContextManager("provider")}
+
+		responses, err := provider.contextManager.onAssociateRequest(&providerParams,
+			user.contextManager.generateAssociateRequest(&userParams))
+		require.NoError(t, err)
+		require.NoError(t, user.contextManager.onAssociateResponse(responses))
+		require.Equal(t, test.wantSendPDUSize, user.sendPDUSize(), "%+v", test)
+		require.Equal(t, int(advertisedPDUSize(test.userMaxPDUSize)), provider.contextManager.peerMaxPDUSize)
+	}
+	require.Equal(t, 0, (&stateMachine{providerParams: ServiceProviderParams{MaxPDUSize: UnlimitedPDUSize}}).receivePDULimit())
+
+	_, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: []string{dicomuid.VerificationSOPClass},
+		MaxPDUSize: 100,
+	})
+	require.Error(t, err)
+}
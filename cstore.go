@@ -1,7 +1,13 @@
 package netdicom
 
 import (
+	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
 
 	"github.com/algm/go-netdicom/dimse"
 	"github.com/grailbio/go-dicom"
@@ -12,11 +18,13 @@ import (
 )
 
 // Helper function used by C-{STORE,GET,MOVE} to send a dataset using C-STORE
-// over an already-established association.
-func runCStoreOnAssociation(upcallCh chan upcallEvent, downcallCh chan stateEvent,
+// over an already-established association. It waits for the response for at
+// most "timeout", or forever if zero, and stops waiting when ctx is done.
+func runCStoreOnAssociation(ctx context.Context, upcallCh chan upcallEvent, downcallCh chan stateEvent,
 	cm *contextManager,
 	messageID dimse.MessageID,
-	ds *dicom.DataSet) error {
+	ds *dicom.DataSet,
+	timeout time.Duration) error {
 	var getElement = func(tag dicomtag.Tag) (string, error) {
 		elem, err := ds.FindElementByTag(tag)
 		if err != nil {
@@ -36,55 +44,208 @@ func runCStoreOnAssociation(upcallCh chan upcallEvent, downcallCh chan stateEven
 	if err != nil {
 		return fmt.Errorf("dicom.cstore: data lacks MediaStorageSOPClassUID: %v", err)
 	}
-	dicomlog.Vprintf(1, "dicom.cstore(%s): DICOM abstractsyntax: %s, sopinstance: %s", cm.label, dicomuid.UIDString(sopClassUID), sopInstanceUID)
-	context, err := cm.lookupByAbstractSyntaxUID(sopClassUID)
+	// Prefer the context whose transfer syntax matches the dataset's encoding,
+	// if any. Otherwise the dataset is converted, which is possible only among
+	// the uncompressed transfer syntaxes.
+	transferSyntaxUID, err := getElement(dicomtag.TransferSyntaxUID)
 	if err != nil {
-		dicomlog.Vprintf(0, "dicom.cstore(%s): sop class %v not found in context %v", cm.label, sopClassUID, err)
+		transferSyntaxUID = ""
+	}
+	dicomlog.Vprintf(1, "dicom.cstore(%s): DICOM abstractsyntax: %s, sopinstance: %s, transfersyntax: %s", cm.label, dicomuid.UIDString(sopClassUID), sopInstanceUID, dicomuid.UIDString(transferSyntaxUID))
+	entry, err := lookupCStoreContext(cm, sopClassUID, transferSyntaxUID)
+	if err != nil {
+		dicomlog.Vprintf(0, "dicom.cstore(%s): no usable context for sop class %v: %v", cm.label, sopClassUID, err)
 		return err
 	}
 	dicomlog.Vprintf(1, "dicom.cstore(%s): using transfersyntax %s to send sop class %s, instance %s",
 		cm.label,
-		dicomuid.UIDString(context.transferSyntaxUID),
+		dicomuid.UIDString(entry.transferSyntaxUID),
 		dicomuid.UIDString(sopClassUID),
 		sopInstanceUID)
-	bodyEncoder := dicomio.NewBytesEncoderWithTransferSyntax(context.transferSyntaxUID)
-	for _, elem := range ds.Elements {
-		if elem.Tag.Group == dicomtag.MetadataGroup {
-			continue
-		}
-		dicom.WriteElement(bodyEncoder, elem)
-	}
-	if err := bodyEncoder.Error(); err != nil {
+	data, err := encodeDataSet(ds, transferSyntaxUID, entry.transferSyntaxUID)
+	if err != nil {
 		dicomlog.Vprintf(0, "dicom.cstore(%s): body encoder failed: %v", cm.label, err)
 		return err
 	}
-	downcallCh <- stateEvent{
-		event: evt09,
-		dimsePayload: &stateEventDIMSEPayload{
-			abstractSyntaxName: sopClassUID,
-			command: &dimse.CStoreRq{
-				AffectedSOPClassUID:    sopClassUID,
-				MessageID:              messageID,
-				CommandDataSetType:     dimse.CommandDataSetTypeNonNull,
-				AffectedSOPInstanceUID: sopInstanceUID,
-			},
-			data: bodyEncoder.Bytes(),
+	payload := &stateEventDIMSEPayload{
+		contextID: entry.contextID,
+		command: &dimse.CStoreRq{
+			AffectedSOPClassUID:    sopClassUID,
+			MessageID:              messageID,
+			CommandDataSetType:     dimse.CommandDataSetTypeNonNull,
+			AffectedSOPInstanceUID: sopInstanceUID,
+		},
+		data: data,
+	}
+	return sendCStore(ctx, upcallCh, downcallCh, cm, payload, timeout)
+}
+
+// Like runCStoreOnAssociation, but sends "size" bytes read from "r": a data
+// set without the group-0002 meta header, encoded in "transferSyntaxUID". The
+// data is read as it is sent. Since it cannot be re-encoded, the association
+// must have accepted sopClassUID in transferSyntaxUID.
+func runCStoreStreamOnAssociation(ctx context.Context, upcallCh chan upcallEvent, downcallCh chan stateEvent,
+	cm *contextManager,
+	messageID dimse.MessageID,
+	sopClassUID, sopInstanceUID, transferSyntaxUID string,
+	r io.Reader, size int64,
+	timeout time.Duration) error {
+	if size < 0 {
+		return fmt.Errorf("dicom.cstore: invalid data size %d", size)
+	}
+	entry, err := cm.lookupByAbstractSyntaxAndTransferSyntaxUID(sopClassUID, transferSyntaxUID)
+	if err != nil {
+		dicomlog.Vprintf(0, "dicom.cstore(%s): sop class %v not found in context %v", cm.label, sopClassUID, err)
+		return err
+	}
+	if entry.transferSyntaxUID != transferSyntaxUID {
+		return fmt.Errorf("dicom.cstore: %s not accepted in transfer syntax %s, which streamed data must be sent in",
+			dicomuid.UIDString(sopClassUID), dicomuid.UIDString(transferSyntaxUID))
+	}
+	dicomlog.Vprintf(1, "dicom.cstore(%s): streaming %db of sop class %s, instance %s",
+		cm.label, size, dicomuid.UIDString(sopClassUID), sopInstanceUID)
+	payload := &stateEventDIMSEPayload{
+		contextID: entry.contextID,
+		command: &dimse.CStoreRq{
+			AffectedSOPClassUID:    sopClassUID,
+			MessageID:              messageID,
+			CommandDataSetType:     dimse.CommandDataSetTypeNonNull,
+			AffectedSOPInstanceUID: sopInstanceUID,
 		},
+		dataReader: contextReader{ctx, r},
+		dataSize:   size,
+		sent:       make(chan struct{}),
+	}
+	return sendCStore(ctx, upcallCh, downcallCh, cm, payload, timeout)
+}
+
+// A reader that fails once ctx is done, so that a transfer in progress stops.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
+// Send a C-STORE-RQ and wait for the response. If payload.sent is set, the
+// response timeout starts once the request has been sent, and the function
+// does not return before then unless ctx is done or the association ends.
+func sendCStore(ctx context.Context, upcallCh chan upcallEvent, downcallCh chan stateEvent,
+	cm *contextManager,
+	payload *stateEventDIMSEPayload,
+	timeout time.Duration) error {
+	downcallCh <- stateEvent{event: evt09, dimsePayload: payload}
+	if payload.sent != nil {
+		var early *upcallEvent
+	wait:
+		for {
+			select {
+			case <-payload.sent:
+				break wait
+			case event, ok := <-upcallCh:
+				if !ok {
+					return fmt.Errorf("%w while sending C-STORE data", errConnectionClosed)
+				}
+				// The peer responded before the end of the
+				// transfer. Wait for the transfer to end, since
+				// it still reads the data.
+				early = &event
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		if early != nil {
+			return checkCStoreResponse(cm, *early)
+		}
+	}
+	dicomlog.Vprintf(0, "dicom.cstore(%s): Start reading resp w/ messageID:%v", cm.label, payload.command.GetMessageID())
+	event, err := readUpcall(ctx, upcallCh, timeout, "C-STORE response")
+	if err != nil {
+		dicomlog.Vprintf(0, "dicom.cstore(%s): %v", cm.label, err)
+		return err
+	}
+	return checkCStoreResponse(cm, event)
+}
+
+// Convert a C-STORE response into the result of the operation.
+func checkCStoreResponse(cm *contextManager, event upcallEvent) error {
+	dicomlog.Vprintf(1, "dicom.cstore(%s): resp event: %v", cm.label, event.command)
+	doassert(event.eventType == upcallEventData)
+	doassert(event.command != nil)
+	resp, ok := event.command.(*dimse.CStoreRsp)
+	if !ok {
+		return &ProtocolError{Err: fmt.Errorf("found wrong response for C-STORE: %v", event.command)}
+	}
+	if resp.Status.Status != 0 {
+		dicomlog.Vprintf(0, "dicom.cstore(%s): failed: %v", cm.label, resp.String())
+		return &StatusError{Op: "C-STORE", Status: resp.Status}
+	}
+	return nil
+}
+
+// The group-0002 meta header of a DICOM file.
+type fileHeader struct {
+	sopClassUID       string
+	sopInstanceUID    string
+	transferSyntaxUID string
+	dataSize          int64 // bytes past the header.
+}
+
+// Open the DICOM file at "path", and parse its meta header. The returned file
+// is positioned at the start of the data set, past the header.
+func openDICOMFile(path string) (*os.File, fileHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fileHeader{}, err
 	}
-	for {
-		dicomlog.Vprintf(0, "dicom.cstore(%s): Start reading resp w/ messageID:%v", cm.label, messageID)
-		event, ok := <-upcallCh
-		if !ok {
-			return fmt.Errorf("dicom.cstore(%s): Connection closed while waiting for C-STORE response", cm.label)
+	header, err := readFileHeader(f)
+	if err != nil {
+		f.Close()
+		return nil, fileHeader{}, fmt.Errorf("dicom.cstore: %s: %w", path, err)
+	}
+	return f, header, nil
+}
+
+// Parse the meta header of "f", and seek to the start of the data set.
+func readFileHeader(f *os.File) (fileHeader, error) {
+	d := dicomio.NewDecoder(f, binary.LittleEndian, dicomio.ExplicitVR)
+	elems := dicom.ParseFileHeader(d)
+	if err := d.Error(); err != nil {
+		return fileHeader{}, err
+	}
+	var header fileHeader
+	for _, field := range []struct {
+		tag dicomtag.Tag
+		v   *string
+	}{
+		{dicomtag.MediaStorageSOPClassUID, &header.sopClassUID},
+		{dicomtag.MediaStorageSOPInstanceUID, &header.sopInstanceUID},
+		{dicomtag.TransferSyntaxUID, &header.transferSyntaxUID},
+	} {
+		elem, err := dicom.FindElementByTag(elems, field.tag)
+		if err != nil {
+			return fileHeader{}, err
 		}
-		dicomlog.Vprintf(1, "dicom.cstore(%s): resp event: %v", cm.label, event.command)
-		doassert(event.eventType == upcallEventData)
-		doassert(event.command != nil)
-		resp, ok := event.command.(*dimse.CStoreRsp)
-		doassert(ok) // TODO(saito)
-		if resp.Status.Status != 0 {
-			return fmt.Errorf("dicom.cstore(%s): failed: %v", cm.label, resp.String())
+		if *field.v, err = elem.GetString(); err != nil {
+			return fileHeader{}, err
 		}
-		return nil
+		// UIDs may be padded with a NUL to an even length.
+		*field.v = strings.TrimRight(*field.v, "\x00 ")
+	}
+	// The decoder reads ahead, so seek to the end of the header explicitly.
+	offset, err := f.Seek(d.BytesRead(), io.SeekStart)
+	if err != nil {
+		return fileHeader{}, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return fileHeader{}, err
 	}
+	header.dataSize = info.Size() - offset
+	return header, nil
 }
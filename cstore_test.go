@@ -0,0 +1,180 @@
+package netdicom
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/algm/go-netdicom/dimse"
+	"github.com/algm/go-netdicom/sopclass"
+	"github.com/stretchr/testify/require"
+)
+
+// Start a provider that records the C-STORE data sets it receives.
+func startRecordingProvider(t *testing.T) (*ServiceProvider, func() [][]byte) {
+	var mu sync.Mutex
+	var received [][]byte
+	sp := startTestProvider(t, ServiceProviderParams{
+		CStore: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string,
+			dataReader io.Reader, dataSize int64) dimse.Status {
+			data, err := io.ReadAll(dataReader)
+			if err != nil {
+				return dimse.Status{Status: dimse.CStoreOutOfResources}
+			}
+			mu.Lock()
+			received = append(received, data)
+			mu.Unlock()
+			return dimse.Success
+		},
+	})
+	return sp, func() [][]byte {
+		mu.Lock()
+		defer mu.Unlock()
+		return received
+	}
+}
+
+func TestCStoreFile(t *testing.T) {
+	const path = "testdata/IM-0001-0003.dcm"
+	f, header, err := openDICOMFile(path)
+	require.NoError(t, err)
+	want, err := io.ReadAll(f)
+	f.Close()
+	require.NoError(t, err)
+	require.Equal(t, header.dataSize, int64(len(want)))
+
+	sp, received := startRecordingProvider(t)
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       []string{header.sopClassUID},
+		TransferSyntaxes: []string{header.transferSyntaxUID},
+		MaxSendPDUSize:   2048,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CStoreFile(path))
+	require.Equal(t, [][]byte{want}, received())
+
+	require.ErrorIs(t, su.CStoreFile("testdata/nonexistent.dcm"), os.ErrNotExist)
+}
+
+func TestCStoreStream(t *testing.T) {
+	f, header, err := openDICOMFile("testdata/IM-0001-0003.dcm")
+	require.NoError(t, err)
+	data, err := io.ReadAll(f)
+	f.Close()
+	require.NoError(t, err)
+
+	sp, received := startRecordingProvider(t)
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       []string{header.sopClassUID},
+		TransferSyntaxes: []string{header.transferSyntaxUID},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	require.NoError(t, su.CStoreStream(header.sopClassUID, "1.2.3.4", header.transferSyntaxUID,
+		bytes.NewReader(data), int64(len(data))))
+	require.Equal(t, [][]byte{data}, received())
+
+	// The data cannot be sent in a transfer syntax that was not accepted.
+	require.Error(t, su.CStoreStream(header.sopClassUID, "1.2.3.5", "1.2.840.10008.1.2.2",
+		bytes.NewReader(data), int64(len(data))))
+	require.Len(t, received(), 1)
+
+	// A reader that ends early aborts the association.
+	err = su.CStoreStream(header.sopClassUID, "1.2.3.6", header.transferSyntaxUID,
+		bytes.NewReader(data[:100]), int64(len(data)))
+	require.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	require.Len(t, received(), 1)
+	require.True(t, su.getStatus() == serviceUserClosed)
+}
+
+// The association keeps handling events while the data of a C-STORE is read,
+// e.g., the A-ABORT the server sends when the client stalls.
+func TestCStoreStreamStalled(t *testing.T) {
+	f, header, err := openDICOMFile("testdata/IM-0001-0003.dcm")
+	require.NoError(t, err)
+	data, err := io.ReadAll(f)
+	f.Close()
+	require.NoError(t, err)
+
+	sp := startTestProvider(t, ServiceProviderParams{
+		IdleTimeout: 200 * time.Millisecond,
+		CStore: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string,
+			dataReader io.Reader, dataSize int64) dimse.Status {
+			_, _ = io.Copy(io.Discard, dataReader)
+			return dimse.Success
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       []string{header.sopClassUID},
+		TransferSyntaxes: []string{header.transferSyntaxUID},
+		MaxSendPDUSize:   2048,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	stalled := io.MultiReader(bytes.NewReader(data[:4096]), readerFunc(func(p []byte) (int, error) {
+		<-unblock
+		return 0, io.EOF
+	}))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- su.CStoreStream(header.sopClassUID, "1.2.3.4", header.transferSyntaxUID, stalled, int64(len(data)))
+	}()
+	select {
+	case err := <-errCh:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("C-STORE did not return after the server aborted the association")
+	}
+}
+
+// Messages sent during the transfer of a data set wait for it to end.
+func TestCStoreStreamWithConcurrentEcho(t *testing.T) {
+	f, header, err := openDICOMFile("testdata/IM-0001-0003.dcm")
+	require.NoError(t, err)
+	data, err := io.ReadAll(f)
+	f.Close()
+	require.NoError(t, err)
+
+	sp, received := startRecordingProvider(t)
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       append([]string{header.sopClassUID}, sopclass.VerificationClasses...),
+		TransferSyntaxes: []string{header.transferSyntaxUID},
+		MaxOpsInvoked:    2,
+		MaxSendPDUSize:   2048,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	started := make(chan struct{})
+	resume := make(chan struct{})
+	slow := io.MultiReader(bytes.NewReader(data[:4096]), readerFunc(func(p []byte) (int, error) {
+		close(started)
+		<-resume
+		return 0, io.EOF
+	}), bytes.NewReader(data[4096:]))
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- su.CStoreStream(header.sopClassUID, "1.2.3.4", header.transferSyntaxUID, slow, int64(len(data)))
+	}()
+	<-started
+	echoErr := make(chan error, 1)
+	go func() { echoErr <- su.CEcho() }()
+	time.Sleep(50 * time.Millisecond)
+	close(resume)
+	require.NoError(t, <-errCh)
+	require.NoError(t, <-echoErr)
+	require.Equal(t, [][]byte{data}, received())
+}
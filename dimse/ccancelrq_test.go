@@ -0,0 +1,51 @@
+package dimse_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/algm/go-netdicom/commandset"
+	"github.com/algm/go-netdicom/dimse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/suyashkumar/dicom"
+)
+
+// Encode "v" and decode it back, as CommandAssembler does.
+func roundTrip(t *testing.T, v dimse.Message) dimse.Message {
+	var buf bytes.Buffer
+	require.NoError(t, dimse.EncodeMessage(&buf, v))
+	size := int64(buf.Len())
+	// Pad the stream for the parser's transfer syntax detection.
+	buf.Write(make([]byte, 100))
+	dataset, err := dicom.Parse(bytes.NewReader(buf.Bytes()), size, nil,
+		dicom.SkipPixelData(), dicom.SkipMetadataReadOnNewParserInit())
+	require.NoError(t, err)
+	decoded, err := dimse.ReadMessage(&dataset)
+	require.NoError(t, err)
+	return decoded
+}
+
+func TestCCancelRq_RoundTrip(t *testing.T) {
+	commandset.Init()
+	for _, v := range []*dimse.CCancelRq{
+		{MessageIDBeingRespondedTo: 0x1234, CommandDataSetType: dimse.CommandDataSetTypeNull},
+		{MessageIDBeingRespondedTo: 1, CommandDataSetType: dimse.CommandDataSetTypeNonNull},
+	} {
+		decoded := roundTrip(t, v)
+		require.IsType(t, &dimse.CCancelRq{}, decoded)
+		c := decoded.(*dimse.CCancelRq)
+		assert.Equal(t, v.MessageIDBeingRespondedTo, c.MessageIDBeingRespondedTo)
+		assert.Equal(t, v.CommandDataSetType, c.CommandDataSetType)
+		assert.Equal(t, v.HasData(), c.HasData())
+		assert.Equal(t, v.MessageIDBeingRespondedTo, c.GetMessageID())
+		assert.Equal(t, uint16(0x0FFF), c.CommandField())
+		assert.Nil(t, c.GetStatus())
+		assert.Equal(t, v.String(), c.String())
+	}
+}
+
+func TestCCancelRq_String(t *testing.T) {
+	v := &dimse.CCancelRq{MessageIDBeingRespondedTo: 7, CommandDataSetType: dimse.CommandDataSetTypeNull}
+	assert.Equal(t, "CCancelRq{MessageIDBeingRespondedTo:7 CommandDataSetType:257}", v.String())
+}
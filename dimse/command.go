@@ -1,27 +1,67 @@
 package dimse
 
 import (
+	"bytes"
 	"io"
 	"os"
 	"sync"
 	"sync/atomic"
 )
 
+// DimseCommand holds the data set of a DIMSE message. The data is kept in
+// memory, spooled to a file, or streamed as it arrives from the network; see
+// CommandAssembler.
 type DimseCommand struct {
-	fpath      string
+	fpath      string // empty if the data is kept in memory.
 	mu         sync.RWMutex
 	dataReader *os.File
 	sizeCache  int64 // cached size (-1 if unknown)
+
+	buf       []byte // the data, if fpath is empty.
+	memReader *bytes.Reader
+
+	// Set once the data is streamed. AppendData writes to pw, and readers
+	// read streamReader: the data received before streaming started,
+	// followed by what comes through the pipe.
+	pr           *io.PipeReader
+	pw           *io.PipeWriter
+	streamReader io.Reader
+
+	spool    *Spool // the spool that created fpath; nil if untracked.
+	reserved int64  // bytes reserved in spool.
+	err      error  // set if the data has been dropped.
 }
 
+// NewDimseCommand creates a DimseCommand that stores its data in the file
+// "fpath". If fpath is empty, the data is kept in memory.
 func NewDimseCommand(fpath string) *DimseCommand {
 	return &DimseCommand{fpath: fpath}
 }
 
 func (dc *DimseCommand) AppendData(data []byte) error {
 	dc.mu.Lock()
+	if pw := dc.pw; pw != nil {
+		dc.mu.Unlock()
+		// Blocks until the data has been read. An error means that the
+		// reader has been closed, e.g., because the handler returned
+		// early; the rest of the data is dropped.
+		_, _ = pw.Write(data)
+		return nil
+	}
 	defer dc.mu.Unlock()
 
+	if dc.err != nil {
+		return nil
+	}
+	if dc.fpath == "" {
+		dc.buf = append(dc.buf, data...)
+		return nil
+	}
+	if !dc.spool.reserve(int64(len(data))) {
+		return dc.drop(ErrSpoolQuotaExceeded)
+	}
+	dc.reserved += int64(len(data))
+
 	// Close dataReader if it's open to prevent concurrent access
 	if dc.dataReader != nil {
 		dc.dataReader.Close()
@@ -29,7 +69,7 @@ func (dc *DimseCommand) AppendData(data []byte) error {
 	}
 
 	// Open file in append mode, create if doesn't exist
-	file, err := os.OpenFile(dc.fpath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	file, err := os.OpenFile(dc.fpath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
 		return err
 	}
@@ -40,16 +80,111 @@ func (dc *DimseCommand) AppendData(data []byte) error {
 	return err
 }
 
-func (dc *DimseCommand) Ack() error {
+// Move the data kept in memory to a file created by "spool". If the spool's
+// quota does not allow for it, the data is dropped instead.
+func (dc *DimseCommand) spill(spool *Spool) error {
 	dc.mu.Lock()
 	defer dc.mu.Unlock()
-
-	err := dc.dataReader.Close()
+	if dc.err != nil {
+		return nil
+	}
+	if !spool.reserve(int64(len(dc.buf))) {
+		return dc.drop(ErrSpoolQuotaExceeded)
+	}
+	fpath, err := spool.create()
 	if err != nil {
+		spool.release(int64(len(dc.buf)))
+		return err
+	}
+	dc.fpath, dc.spool, dc.reserved = fpath, spool, int64(len(dc.buf))
+	if err := os.WriteFile(fpath, dc.buf, 0600); err != nil {
 		return err
 	}
+	dc.buf, dc.memReader = nil, nil
+	return nil
+}
+
+// Discard the data, and make readers fail with "err". Further data is
+// ignored. Requires dc.mu.
+func (dc *DimseCommand) drop(err error) error {
+	dc.err = err
+	dc.buf, dc.memReader = nil, nil
+	return dc.removeFile()
+}
+
+// Remove the spool file, if any. Requires dc.mu.
+func (dc *DimseCommand) removeFile() error {
+	if dc.dataReader != nil {
+		dc.dataReader.Close()
+		dc.dataReader = nil
+	}
+	if dc.fpath == "" {
+		return nil
+	}
+	fpath := dc.fpath
+	dc.fpath = ""
+	if dc.spool == nil {
+		return os.Remove(fpath)
+	}
+	reserved := dc.reserved
+	dc.reserved = 0
+	return dc.spool.remove(fpath, reserved)
+}
+
+// Err reports why the data has been dropped, e.g., ErrSpoolQuotaExceeded. It
+// returns nil if the data is available.
+func (dc *DimseCommand) Err() error {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	return dc.err
+}
+
+// Switch to streaming. Readers see the data received so far, followed by the
+// data passed to AppendData until finishStream is called.
+func (dc *DimseCommand) startStream() error {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	var head io.Reader
+	if dc.fpath == "" {
+		head = bytes.NewReader(dc.buf)
+	} else {
+		if dc.dataReader != nil {
+			dc.dataReader.Close()
+		}
+		f, err := os.Open(dc.fpath)
+		if err != nil {
+			return err
+		}
+		dc.dataReader = f
+		head = f
+	}
+	dc.pr, dc.pw = io.Pipe()
+	dc.streamReader = io.MultiReader(head, dc.pr)
+	return nil
+}
+
+// End the stream started by startStream. A nil err makes readers see io.EOF
+// after the data, and a non-nil err makes them see err.
+func (dc *DimseCommand) finishStream(err error) {
+	dc.mu.Lock()
+	pw := dc.pw
+	dc.mu.Unlock()
+	if pw != nil {
+		pw.CloseWithError(err)
+	}
+}
 
-	return os.Remove(dc.fpath)
+// Ack releases the data. Further fragments of a data set being streamed are
+// dropped.
+func (dc *DimseCommand) Ack() error {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	if dc.pr != nil {
+		dc.pr.Close()
+	}
+	dc.buf, dc.memReader = nil, nil
+	return dc.removeFile()
 }
 
 func (dc *DimseCommand) Close() error {
@@ -63,10 +198,22 @@ func (dc *DimseCommand) Close() error {
 	return nil
 }
 
+// ReadData returns a reader positioned at the start of the data. A streamed
+// data set can be read only once, so the reader is returned as is.
 func (dc *DimseCommand) ReadData() io.Reader {
 	dc.mu.Lock()
 	defer dc.mu.Unlock()
 
+	if dc.err != nil {
+		return dc
+	}
+	if dc.streamReader != nil {
+		return dc.streamReader
+	}
+	if dc.fpath == "" {
+		dc.memReader = bytes.NewReader(dc.buf)
+		return dc.memReader
+	}
 	if dc.dataReader == nil {
 		f, err := os.Open(dc.fpath)
 		if err != nil {
@@ -81,9 +228,28 @@ func (dc *DimseCommand) ReadData() io.Reader {
 	return dc.dataReader
 }
 
-// Read implements io.Reader by delegating to an internal *os.File reader.
+// Read implements io.Reader by delegating to the underlying memory buffer,
+// file, or stream.
 func (dc *DimseCommand) Read(p []byte) (int, error) {
 	dc.mu.Lock()
+	if dc.err != nil {
+		err := dc.err
+		dc.mu.Unlock()
+		return 0, err
+	}
+	if dc.streamReader != nil {
+		r := dc.streamReader
+		dc.mu.Unlock()
+		return r.Read(p)
+	}
+	if dc.fpath == "" {
+		if dc.memReader == nil {
+			dc.memReader = bytes.NewReader(dc.buf)
+		}
+		r := dc.memReader
+		dc.mu.Unlock()
+		return r.Read(p)
+	}
 	if dc.dataReader == nil {
 		f, err := os.Open(dc.fpath)
 		if err != nil {
@@ -97,8 +263,19 @@ func (dc *DimseCommand) Read(p []byte) (int, error) {
 	return r.Read(p)
 }
 
-// Size returns the current size of the underlying file. Returns -1 on error.
+// Size returns the size of the data. Returns -1 if the data is streamed, since
+// its size is not known until it has been received, if it has been dropped, or
+// on error.
 func (dc *DimseCommand) Size() int64 {
+	dc.mu.Lock()
+	streamed, inMemory, size := dc.streamReader != nil || dc.err != nil, dc.fpath == "", int64(len(dc.buf))
+	dc.mu.Unlock()
+	if streamed {
+		return -1
+	}
+	if inMemory {
+		return size
+	}
 	if v := atomic.LoadInt64(&dc.sizeCache); v > 0 {
 		return v
 	}
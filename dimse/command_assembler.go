@@ -3,15 +3,41 @@ package dimse
 import (
 	"bytes"
 	"fmt"
-	"os"
+	"io"
 
 	"github.com/algm/go-netdicom/pdu"
 	"github.com/suyashkumar/dicom"
 )
 
+// Number of bytes the DICOM parser peeks at to infer the transfer syntax.
+const commandPeekSize = 100
+
+// DefaultMemoryThreshold is the default value of
+// CommandAssembler.MemoryThreshold.
+const DefaultMemoryThreshold = 1 << 20
+
 // CommandAssembler is a helper that assembles a DIMSE command message and data
 // payload from a sequence of P_DATA_TF PDUs.
 type CommandAssembler struct {
+	// MemoryThreshold is the data set size, in bytes, up to which the data
+	// is kept in memory. Larger data sets are spooled to a temporary file.
+	// Zero means DefaultMemoryThreshold.
+	MemoryThreshold int64
+
+	// StreamingThreshold, if positive, is the data set size above which the
+	// data is streamed: once more than this many bytes have been received,
+	// AddDataPDU returns the command along with a DimseCommand that reads
+	// the data received so far, and then the remaining fragments as they
+	// arrive.
+	StreamingThreshold int64
+
+	// Spool, if non-nil, creates the files that data sets are spooled to,
+	// and enforces its quota on them. A data set that would exceed the
+	// quota is dropped: it is still returned, so that the command can be
+	// answered, but its DimseCommand.Err reports ErrSpoolQuotaExceeded. If
+	// nil, the files are created in os.TempDir().
+	Spool *Spool
+
 	contextID      byte
 	commandBytes   []byte
 	command        Message
@@ -19,13 +45,20 @@ type CommandAssembler struct {
 
 	readAllData bool
 
-	dataCmd *DimseCommand // temporary file holder for data set
+	dataCmd  *DimseCommand // holder for data set
+	dataSize int64         // bytes of data received so far
+
+	// Set once the command has been returned with a streamed data set. The
+	// remaining data fragments are passed on to dataCmd.
+	streaming bool
 }
 
 // AddDataPDU is to be called for each P_DATA_TF PDU received from the
-// network. If the fragment is marked as the last one, AddDataPDU returns
-// <SOPUID, TransferSyntaxUID, payload, nil>.  If it needs more fragments, it
-// returns <"", "", nil, nil>.  On error, it returns a non-nil error.
+// network. Once the command and its data set have been received, or the data
+// set has grown past StreamingThreshold, AddDataPDU returns <contextID,
+// command, data, nil>; data is nil if the command has no data set. If it needs
+// more fragments, it returns <0, nil, nil, nil>.  On error, it returns a
+// non-nil error.
 func (commandAssembler *CommandAssembler) AddDataPDU(pdu *pdu.PDataTf) (byte, Message, *DimseCommand, error) {
 	for _, item := range pdu.Items {
 		if commandAssembler.contextID == 0 {
@@ -42,27 +75,29 @@ func (commandAssembler *CommandAssembler) AddDataPDU(pdu *pdu.PDataTf) (byte, Me
 				commandAssembler.readAllCommand = true
 			}
 		} else {
-			// Data fragment. Persist to temporary file using DimseCommand.
-			if commandAssembler.dataCmd == nil {
-				tmpFile, err := os.CreateTemp("", "dimse_data_*")
-				if err != nil {
-					return 0, nil, nil, fmt.Errorf("failed to create temp file for DIMSE data: %w", err)
-				}
-				tmpFile.Close()
-				commandAssembler.dataCmd = NewDimseCommand(tmpFile.Name())
-			}
-			if err := commandAssembler.dataCmd.AppendData(item.Value); err != nil {
-				return 0, nil, nil, fmt.Errorf("failed to append data fragment: %w", err)
+			if err := commandAssembler.addData(item.Value); err != nil {
+				return 0, nil, nil, err
 			}
 			if item.Last {
 				if commandAssembler.readAllData {
 					return 0, nil, nil, fmt.Errorf("P_DATA_TF: found >1 data chunks with the Last bit set")
 				}
 				commandAssembler.readAllData = true
+				if commandAssembler.streaming {
+					commandAssembler.dataCmd.finishStream(nil)
+				}
 			}
 		}
 	}
 
+	// The command has been returned already.
+	if commandAssembler.streaming {
+		if commandAssembler.readAllData {
+			commandAssembler.reset()
+		}
+		return 0, nil, nil, nil
+	}
+
 	// Wait until full command received
 	if !commandAssembler.readAllCommand {
 		return 0, nil, nil, nil
@@ -70,8 +105,14 @@ func (commandAssembler *CommandAssembler) AddDataPDU(pdu *pdu.PDataTf) (byte, Me
 
 	// Decode command once.
 	if commandAssembler.command == nil {
-		ioReader := bytes.NewReader(commandAssembler.commandBytes)
-		parser, err := dicom.Parse(ioReader, int64(ioReader.Len()), nil, dicom.SkipPixelData(), dicom.SkipMetadataReadOnNewParserInit())
+		// Commands are always in implicit VR little endian (P3.7 6.3.1), but
+		// the parser infers the transfer syntax by peeking at the first 100
+		// bytes, which fails for short commands such as C-ECHO-RQ. Pad the
+		// stream; the padding lies past the read limit and is never parsed.
+		ioReader := io.MultiReader(
+			bytes.NewReader(commandAssembler.commandBytes),
+			bytes.NewReader(make([]byte, commandPeekSize)))
+		parser, err := dicom.Parse(ioReader, int64(len(commandAssembler.commandBytes)), nil, dicom.SkipPixelData(), dicom.SkipMetadataReadOnNewParserInit())
 		if err != nil {
 			return 0, nil, nil, fmt.Errorf("P_DATA_TF: failed to parse command bytes: %w", err)
 		}
@@ -81,9 +122,18 @@ func (commandAssembler *CommandAssembler) AddDataPDU(pdu *pdu.PDataTf) (byte, Me
 		}
 	}
 
-	// If command expects data but we haven't read all yet, wait.
+	// If command expects data but we haven't read all yet, wait, unless
+	// the data is large enough to be streamed.
 	if commandAssembler.command.HasData() && !commandAssembler.readAllData {
-		return 0, nil, nil, nil
+		if commandAssembler.StreamingThreshold <= 0 || commandAssembler.dataSize <= commandAssembler.StreamingThreshold ||
+			commandAssembler.dataCmd.Err() != nil {
+			return 0, nil, nil, nil
+		}
+		if err := commandAssembler.dataCmd.startStream(); err != nil {
+			return 0, nil, nil, fmt.Errorf("failed to stream DIMSE data: %w", err)
+		}
+		commandAssembler.streaming = true
+		return commandAssembler.contextID, commandAssembler.command, commandAssembler.dataCmd, nil
 	}
 
 	// Prepare return values.
@@ -93,7 +143,54 @@ func (commandAssembler *CommandAssembler) AddDataPDU(pdu *pdu.PDataTf) (byte, Me
 	dc := commandAssembler.dataCmd
 
 	// Reset assembler for next message.
-	*commandAssembler = CommandAssembler{}
+	commandAssembler.reset()
 
 	return contextID, command, dc, nil
 }
+
+// Append a data fragment to dataCmd. The data set is spooled to a temporary
+// file once it outgrows MemoryThreshold, unless it is being streamed.
+func (commandAssembler *CommandAssembler) addData(data []byte) error {
+	if commandAssembler.dataCmd == nil {
+		commandAssembler.dataCmd = NewDimseCommand("")
+	}
+	dc := commandAssembler.dataCmd
+	if err := dc.AppendData(data); err != nil {
+		return fmt.Errorf("failed to append data fragment: %w", err)
+	}
+	commandAssembler.dataSize += int64(len(data))
+	threshold := commandAssembler.MemoryThreshold
+	if threshold <= 0 {
+		threshold = DefaultMemoryThreshold
+	}
+	if commandAssembler.streaming || dc.fpath != "" || commandAssembler.dataSize <= threshold {
+		return nil
+	}
+	if err := dc.spill(commandAssembler.Spool); err != nil {
+		return fmt.Errorf("failed to spool DIMSE data: %w", err)
+	}
+	return nil
+}
+
+// Abort discards the message being assembled, e.g., because the association
+// has ended. Readers of a data set being streamed see err.
+func (commandAssembler *CommandAssembler) Abort(err error) {
+	if dc := commandAssembler.dataCmd; dc != nil {
+		if commandAssembler.streaming {
+			// The data set belongs to the handler, which acks it.
+			dc.finishStream(err)
+		} else {
+			_ = dc.Ack()
+		}
+	}
+	commandAssembler.reset()
+}
+
+// Prepare for the next message, keeping the settings.
+func (commandAssembler *CommandAssembler) reset() {
+	*commandAssembler = CommandAssembler{
+		MemoryThreshold:    commandAssembler.MemoryThreshold,
+		StreamingThreshold: commandAssembler.StreamingThreshold,
+		Spool:              commandAssembler.Spool,
+	}
+}
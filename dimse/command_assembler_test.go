@@ -3,6 +3,7 @@ package dimse
 import (
 	"bytes"
 	"io"
+	"os"
 	"testing"
 
 	"github.com/algm/go-netdicom/commandset"
@@ -73,6 +74,29 @@ func TestCommandAssembler(t *testing.T) {
 		}
 	})
 
+	t.Run("ShortCommand", func(t *testing.T) {
+		var buf bytes.Buffer
+		err := EncodeMessage(&buf, &CEchoRq{MessageID: 3, CommandDataSetType: CommandDataSetTypeNull})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() >= commandPeekSize {
+			t.Fatalf("C-ECHO-RQ unexpectedly long: %d bytes", buf.Len())
+		}
+		assembler := &CommandAssembler{}
+		contextID, msg, dc, err := assembler.AddDataPDU(createPDataTf(1, true, true, buf.Bytes()))
+		if err != nil {
+			t.Fatalf("Command PDU failed: %v", err)
+		}
+		if contextID != 1 || dc != nil {
+			t.Errorf("Unexpected assembly result: %d %v", contextID, dc)
+		}
+		echo, ok := msg.(*CEchoRq)
+		if !ok || echo.MessageID != 3 {
+			t.Errorf("Expected C-ECHO-RQ with message ID 3, got %v", msg)
+		}
+	})
+
 	t.Run("MultiFragmentData", func(t *testing.T) {
 		commandBytes := createValidCStoreRqBytes()
 		testData := []byte("test data payload for multi fragment")
@@ -182,4 +206,95 @@ func TestCommandAssembler(t *testing.T) {
 			t.Errorf("Expected commandBytes 'part1part2', got '%s'", string(assembler.commandBytes))
 		}
 	})
+	t.Run("SpoolLargeData", func(t *testing.T) {
+		assembler := &CommandAssembler{MemoryThreshold: 8}
+		if _, _, _, err := assembler.AddDataPDU(createPDataTf(1, true, true, createValidCStoreRqBytes())); err != nil {
+			t.Fatalf("Command PDU failed: %v", err)
+		}
+		if _, _, dc, err := assembler.AddDataPDU(createPDataTf(1, false, false, []byte("small"))); err != nil || dc != nil {
+			t.Fatalf("First data fragment: %v %v", dc, err)
+		}
+		if assembler.dataCmd.fpath != "" {
+			t.Error("Data below MemoryThreshold should be kept in memory")
+		}
+		_, _, dc, err := assembler.AddDataPDU(createPDataTf(1, false, true, []byte(" and more")))
+		if err != nil || dc == nil {
+			t.Fatalf("Second data fragment: %v %v", dc, err)
+		}
+		fpath := dc.fpath
+		if fpath == "" {
+			t.Fatal("Data above MemoryThreshold should be spooled to a file")
+		}
+		if dc.Size() != 14 {
+			t.Errorf("Expected size 14, got %d", dc.Size())
+		}
+		b, _ := io.ReadAll(dc.ReadData())
+		if string(b) != "small and more" {
+			t.Errorf("Unexpected data %q", b)
+		}
+		if err := dc.Ack(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := os.Stat(fpath); !os.IsNotExist(err) {
+			t.Error("Spooled file should have been removed by Ack")
+		}
+		if assembler.MemoryThreshold != 8 {
+			t.Error("Settings should survive the reset")
+		}
+	})
+
+	t.Run("StreamLargeData", func(t *testing.T) {
+		assembler := &CommandAssembler{StreamingThreshold: 4}
+		if _, _, _, err := assembler.AddDataPDU(createPDataTf(1, true, true, createValidCStoreRqBytes())); err != nil {
+			t.Fatalf("Command PDU failed: %v", err)
+		}
+		contextID, msg, dc, err := assembler.AddDataPDU(createPDataTf(1, false, false, []byte("first ")))
+		if err != nil || contextID != 1 || msg == nil || dc == nil {
+			t.Fatalf("Expected the command once the data passes StreamingThreshold: %v %v %v", msg, dc, err)
+		}
+		if dc.Size() != -1 {
+			t.Errorf("Expected unknown size, got %d", dc.Size())
+		}
+		done := make(chan string)
+		go func() {
+			b, _ := io.ReadAll(dc)
+			done <- string(b)
+		}()
+		for _, fragment := range []string{"second ", "third"} {
+			_, msg, dc, err := assembler.AddDataPDU(createPDataTf(1, false, fragment == "third", []byte(fragment)))
+			if err != nil || msg != nil || dc != nil {
+				t.Fatalf("Streamed fragment: %v %v %v", msg, dc, err)
+			}
+		}
+		if got := <-done; got != "first second third" {
+			t.Errorf("Unexpected data %q", got)
+		}
+		dc.Ack()
+		if assembler.streaming || assembler.dataCmd != nil {
+			t.Error("Assembler should be reset after the last fragment")
+		}
+	})
+
+	t.Run("AbortStream", func(t *testing.T) {
+		assembler := &CommandAssembler{StreamingThreshold: 1}
+		assembler.AddDataPDU(createPDataTf(1, true, true, createValidCStoreRqBytes()))
+		_, _, dc, err := assembler.AddDataPDU(createPDataTf(1, false, false, []byte("partial")))
+		if err != nil || dc == nil {
+			t.Fatalf("Expected a streamed data set: %v %v", dc, err)
+		}
+		assembler.Abort(io.ErrUnexpectedEOF)
+		b, err := io.ReadAll(dc)
+		if string(b) != "partial" || err != io.ErrUnexpectedEOF {
+			t.Errorf("Expected the partial data and ErrUnexpectedEOF, got %q %v", b, err)
+		}
+		dc.Ack()
+	})
+
+	t.Run("AckWithoutRead", func(t *testing.T) {
+		dc := NewDimseCommand("")
+		dc.AppendData([]byte("data"))
+		if err := dc.Ack(); err != nil {
+			t.Fatal(err)
+		}
+	})
 }
@@ -37,6 +37,7 @@ const (
 	CommandFieldCMoveRsp  uint16 = 0x8021
 	CommandFieldCEchoRq   uint16 = 0x0030
 	CommandFieldCEchoRsp  uint16 = 0x8030
+	CommandFieldCCancelRq uint16 = 0x0FFF
 )
 
 type MessageID = uint16
@@ -55,6 +55,8 @@ func (d *MessageDecoder) Decode(commandField uint16) (Message, error) {
 		return CEchoRq{}.decode(d)
 	case CommandFieldCEchoRsp:
 		return CEchoRsp{}.decode(d)
+	case CommandFieldCCancelRq:
+		return CCancelRq{}.decode(d)
 	default:
 		return nil, fmt.Errorf("unknown DIMSE command 0x%x", commandField)
 	}
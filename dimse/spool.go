@@ -0,0 +1,147 @@
+package dimse
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Prefix of the names of spool files.
+const spoolFilePrefix = "dimse_data_"
+
+// ErrSpoolQuotaExceeded is reported by DimseCommand.Err when a data set was
+// dropped because spooling it would have exceeded a Spool's quota.
+var ErrSpoolQuotaExceeded = errors.New("dimse: spool quota exceeded")
+
+// Spool manages the temporary files that hold data sets too large to keep in
+// memory. It enforces a disk quota, and keeps track of its files so that they
+// can be removed when they are no longer needed. Spool is safe for concurrent
+// use.
+type Spool struct {
+	dir    string
+	limit  int64 // <= 0 means unlimited.
+	parent *Spool
+
+	mu    sync.Mutex
+	used  int64               // guarded by mu
+	files map[string]struct{} // guarded by mu
+}
+
+// NewSpool creates a spool that stores its files in "dir", or in os.TempDir()
+// if dir is empty. If limit is positive, the files may take at most that many
+// bytes. If parent is non-nil, the files also count against the parent's
+// quota, e.g., to combine per-association and global quotas.
+func NewSpool(dir string, limit int64, parent *Spool) *Spool {
+	return &Spool{dir: dir, limit: limit, parent: parent, files: make(map[string]struct{})}
+}
+
+// Create an empty spool file. A nil spool creates an untracked file in
+// os.TempDir().
+func (s *Spool) create() (string, error) {
+	dir := ""
+	if s != nil {
+		dir = s.dir
+	}
+	f, err := os.CreateTemp(dir, spoolFilePrefix+"*")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	if s != nil {
+		s.mu.Lock()
+		s.files[f.Name()] = struct{}{}
+		s.mu.Unlock()
+	}
+	return f.Name(), nil
+}
+
+// Reserve n bytes. Returns false, reserving nothing, if that would exceed the
+// quota of s or of one of its ancestors. A nil spool has no quota.
+func (s *Spool) reserve(n int64) bool {
+	if s == nil {
+		return true
+	}
+	s.mu.Lock()
+	if s.limit > 0 && s.used+n > s.limit {
+		s.mu.Unlock()
+		return false
+	}
+	s.used += n
+	s.mu.Unlock()
+	if !s.parent.reserve(n) {
+		s.mu.Lock()
+		s.used -= n
+		s.mu.Unlock()
+		return false
+	}
+	return true
+}
+
+// Remove the spool file "fpath", and return the "n" bytes reserved for it.
+func (s *Spool) remove(fpath string, n int64) error {
+	err := os.Remove(fpath)
+	if s == nil {
+		return err
+	}
+	s.mu.Lock()
+	_, tracked := s.files[fpath]
+	delete(s.files, fpath)
+	s.mu.Unlock()
+	if tracked { // else Close has released it already.
+		s.release(n)
+	}
+	return err
+}
+
+func (s *Spool) release(n int64) {
+	for ; s != nil; s = s.parent {
+		s.mu.Lock()
+		s.used -= n
+		s.mu.Unlock()
+	}
+}
+
+// Used returns the number of bytes taken by the spool files, including those
+// of the child spools.
+func (s *Spool) Used() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.used
+}
+
+// Close removes the files of the spool that have not been released yet, e.g.,
+// because a handler never acked its data set. The removed files no longer
+// count against the parent's quota.
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	files := s.files
+	s.files = make(map[string]struct{})
+	used := s.used
+	s.mu.Unlock()
+	var firstErr error
+	for fpath := range files {
+		if err := os.Remove(fpath); err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.release(used)
+	return firstErr
+}
+
+// RemoveSpoolFiles removes the spool files in "dir", e.g., the ones left
+// behind by a process that crashed. The directory must not be in use by a
+// running Spool.
+func RemoveSpoolFiles(dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, spoolFilePrefix+"*"))
+	if err != nil {
+		return err
+	}
+	var firstErr error
+	for _, path := range paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
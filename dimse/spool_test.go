@@ -0,0 +1,106 @@
+package dimse
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSpoolQuota(t *testing.T) {
+	dir := t.TempDir()
+	global := NewSpool(dir, 10, nil)
+	spool := NewSpool(dir, 8, global)
+
+	dc := NewDimseCommand("")
+	dc.AppendData([]byte("12345"))
+	if err := dc.spill(spool); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(dc.fpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected mode 0600, got %v", info.Mode().Perm())
+	}
+	if spool.Used() != 5 || global.Used() != 5 {
+		t.Errorf("Expected 5 bytes used, got %d %d", spool.Used(), global.Used())
+	}
+
+	// Exceeds the quota of spool, but not of global.
+	dc.AppendData([]byte("6789"))
+	if dc.Err() != ErrSpoolQuotaExceeded {
+		t.Fatalf("Expected ErrSpoolQuotaExceeded, got %v", dc.Err())
+	}
+	if _, err := io.ReadAll(dc.ReadData()); err != ErrSpoolQuotaExceeded {
+		t.Errorf("Expected reads to fail, got %v", err)
+	}
+	if spool.Used() != 0 || global.Used() != 0 {
+		t.Errorf("Expected the dropped data to be released, got %d %d", spool.Used(), global.Used())
+	}
+	dc.Ack()
+
+	// Exceeds the quota of global.
+	other := NewSpool(dir, 0, global)
+	dc1, dc2 := NewDimseCommand(""), NewDimseCommand("")
+	dc1.AppendData([]byte("1234567"))
+	dc2.AppendData([]byte("1234"))
+	if err := dc1.spill(other); err != nil || dc1.Err() != nil {
+		t.Fatal(err, dc1.Err())
+	}
+	if err := dc2.spill(spool); err != nil || dc2.Err() != ErrSpoolQuotaExceeded {
+		t.Fatalf("Expected ErrSpoolQuotaExceeded, got %v %v", err, dc2.Err())
+	}
+	if err := dc1.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	if global.Used() != 0 {
+		t.Errorf("Expected 0 bytes used, got %d", global.Used())
+	}
+}
+
+func TestSpoolClose(t *testing.T) {
+	dir := t.TempDir()
+	global := NewSpool(dir, 0, nil)
+	spool := NewSpool(dir, 0, global)
+	dc := NewDimseCommand("")
+	dc.AppendData([]byte("never acked"))
+	if err := dc.spill(spool); err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dc.fpath); !os.IsNotExist(err) {
+		t.Error("Close should have removed the spool file")
+	}
+	if global.Used() != 0 {
+		t.Errorf("Expected 0 bytes used, got %d", global.Used())
+	}
+	// A late ack does not release the bytes twice.
+	dc.Ack()
+	if global.Used() != 0 {
+		t.Errorf("Expected 0 bytes used, got %d", global.Used())
+	}
+}
+
+func TestRemoveSpoolFiles(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, spoolFilePrefix+"123")
+	other := filepath.Join(dir, "other")
+	for _, path := range []string{stale, other} {
+		if err := os.WriteFile(path, []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := RemoveSpoolFiles(dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Error("Stale spool file should have been removed")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("Unrelated file should have been kept: %v", err)
+	}
+}
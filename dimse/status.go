@@ -48,6 +48,7 @@ const (
 	CMoveOutOfResourcesUnableToPerformSubOperations     StatusCode = 0xa702
 	CMoveMoveDestinationUnknown                         StatusCode = 0xa801
 	CMoveDataSetDoesNotMatchSOPClass                    StatusCode = 0xa900
+	CMoveSubOperationsCompleteWithFailures              StatusCode = 0xb000
 
 	// Warning codes.
 	StatusAttributeValueOutOfRange StatusCode = 0x0116
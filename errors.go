@@ -0,0 +1,105 @@
+package netdicom
+
+// This file defines the errors returned by ServiceUser methods.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/algm/go-netdicom/dimse"
+	"github.com/algm/go-netdicom/pdu"
+)
+
+// TimeoutError is returned when the peer fails to respond within one of the
+// timeouts set in ServiceUserParams. The association is aborted when it
+// happens.
+type TimeoutError struct {
+	// What timed out, e.g., "connect", "A-ASSOCIATE response", "C-FIND
+	// response", or "idle association".
+	Op string
+	// The timeout that expired.
+	Duration time.Duration
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("dicom: %s timed out after %v", e.Op, e.Duration)
+}
+
+// Timeout returns true. It makes TimeoutError satisfy net.Error.
+func (e *TimeoutError) Timeout() bool { return true }
+
+// Temporary returns false. It makes TimeoutError satisfy net.Error.
+func (e *TimeoutError) Temporary() bool { return false }
+
+// errConnectionClosed is wrapped in the error reported when the association
+// ends while an operation waits for a response.
+var errConnectionClosed = errors.New("connection closed")
+
+// errDataSetIncomplete is seen by the reader of a streamed data set when the
+// association ends before the data set has been received.
+var errDataSetIncomplete = fmt.Errorf("%w: association ended before the data set was received", io.ErrUnexpectedEOF)
+
+// AssociationRejectedError is returned when the server rejects the association
+// with A-ASSOCIATE-RJ (P3.8 9.3.4).
+type AssociationRejectedError struct {
+	Result pdu.RejectResultType
+	Source pdu.SourceType
+	// The meaning of Reason depends on Source. The pdu.RejectReason*
+	// constants are the reasons for pdu.SourceULServiceUser.
+	Reason pdu.RejectReasonType
+}
+
+func (e *AssociationRejectedError) Error() string {
+	return fmt.Sprintf("dicom: association rejected: result %v, source %v, reason %d",
+		e.Result, e.Source, e.Reason)
+}
+
+// Transient returns true if the server may accept the association if retried
+// later.
+func (e *AssociationRejectedError) Transient() bool {
+	return e.Result == pdu.ResultRejectedTransient
+}
+
+// AssociationAbortedError is returned when the peer aborts the association with
+// A-ABORT (P3.8 9.3.8).
+type AssociationAbortedError struct {
+	// 0 if the peer's service user aborted the association, 2 if its upper
+	// layer service provider did.
+	Source pdu.SourceType
+	// Set only when Source is 2.
+	Reason pdu.AbortReasonType
+}
+
+func (e *AssociationAbortedError) Error() string {
+	return fmt.Sprintf("dicom: association aborted by peer: source %d, reason %v", e.Source, e.Reason)
+}
+
+// ProtocolError is returned when the peer violates the DICOM protocol, e.g., by
+// sending a malformed PDU or an unexpected DIMSE message. The association is
+// aborted if the violation is at the PDU level.
+type ProtocolError struct {
+	Err error
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("dicom: protocol error: %v", e.Err)
+}
+
+func (e *ProtocolError) Unwrap() error { return e.Err }
+
+// StatusError is returned when the peer ends a DIMSE operation with a failure
+// status. The association remains usable.
+type StatusError struct {
+	// The operation, e.g., "C-STORE".
+	Op     string
+	Status dimse.Status
+}
+
+func (e *StatusError) Error() string {
+	if e.Status.ErrorComment != "" {
+		return fmt.Sprintf("dicom: %s failed: %v: %s", e.Op, e.Status.Status, e.Status.ErrorComment)
+	}
+	return fmt.Sprintf("dicom: %s failed: %v", e.Op, e.Status.Status)
+}
@@ -71,7 +71,8 @@ func EncodePDU(pdu PDU) ([]byte, error) {
 }
 
 // EncodePDU reads a "pdu" from a stream. maxPDUSize defines the maximum
-// possible PDU size, in bytes, accepted by the caller.
+// possible PDU size, in bytes, accepted by the caller. A value <= 0 disables
+// the check.
 func ReadPDU(in io.Reader, maxPDUSize int) (PDU, error) {
 	var pduType Type
 	var skip byte
@@ -88,7 +89,7 @@ func ReadPDU(in io.Reader, maxPDUSize int) (PDU, error) {
 	if err != nil {
 		return nil, err
 	}
-	if length >= uint32(maxPDUSize)*2 {
+	if maxPDUSize > 0 && uint64(length) >= uint64(maxPDUSize)*2 {
 		// Avoid using too much memory. *2 is just an arbitrary slack.
 		return nil, fmt.Errorf("Invalid length %d; it's much larger than max PDU size of %d", length, maxPDUSize)
 	}
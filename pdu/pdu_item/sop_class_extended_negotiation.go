@@ -0,0 +1,143 @@
+package pdu_item
+
+import (
+	"fmt"
+
+	"github.com/suyashkumar/dicom/pkg/dicomio"
+)
+
+// PS3.7 Annex D.3.3.5
+type SOPClassExtendedNegotiationSubItem struct {
+	SOPClassUID string
+	// Service-class specific flags, e.g., relational-query support for
+	// C-FIND (PS3.4 C.3.5) or the storage level-2 flags (PS3.4 B.3.1).
+	ServiceClassApplicationInformation []byte
+}
+
+func readUIDWithLength(d *dicomio.Reader) (string, error) {
+	uidLen, err := d.ReadUInt16()
+	if err != nil {
+		return "", err
+	}
+	return d.ReadString(uint32(uidLen))
+}
+
+func writeUIDWithLength(e *dicomio.Writer, uid string) error {
+	if err := e.WriteUInt16(uint16(len(uid))); err != nil {
+		return err
+	}
+	return e.WriteString(uid)
+}
+
+func decodeSOPClassExtendedNegotiationSubItem(d *dicomio.Reader, length uint16) (*SOPClassExtendedNegotiationSubItem, error) {
+	uid, err := readUIDWithLength(d)
+	if err != nil {
+		return nil, err
+	}
+	infoLen := int(length) - 2 - len(uid)
+	if infoLen < 0 {
+		return nil, fmt.Errorf("SOPClassExtendedNegotiationSubItem: item length %d too short for UID %q", length, uid)
+	}
+	info, err := readBytes(d, infoLen)
+	if err != nil {
+		return nil, err
+	}
+	return &SOPClassExtendedNegotiationSubItem{
+		SOPClassUID:                        uid,
+		ServiceClassApplicationInformation: info,
+	}, nil
+}
+
+func (v *SOPClassExtendedNegotiationSubItem) Write(e *dicomio.Writer) error {
+	length := 2 + len(v.SOPClassUID) + len(v.ServiceClassApplicationInformation)
+	if length > 0xffff {
+		return fmt.Errorf("SOPClassExtendedNegotiationSubItem: too long: %d bytes", length)
+	}
+	if err := encodeSubItemHeader(e, ItemTypeSOPClassExtendedNegotiation, uint16(length)); err != nil {
+		return err
+	}
+	if err := writeUIDWithLength(e, v.SOPClassUID); err != nil {
+		return err
+	}
+	return e.WriteBytes(v.ServiceClassApplicationInformation)
+}
+
+func (v *SOPClassExtendedNegotiationSubItem) String() string {
+	return fmt.Sprintf("SOPClassExtendedNegotiation{sopclassuid: %v, info: %v}",
+		v.SOPClassUID, v.ServiceClassApplicationInformation)
+}
+
+// PS3.7 Annex D.3.3.6
+type SOPClassCommonExtendedNegotiationSubItem struct {
+	SOPClassUID     string
+	ServiceClassUID string
+	// Related general SOP classes, e.g., the generic storage SOP class that
+	// SOPClassUID specializes.
+	RelatedGeneralSOPClassUIDs []string
+}
+
+func decodeSOPClassCommonExtendedNegotiationSubItem(d *dicomio.Reader, length uint16) (*SOPClassCommonExtendedNegotiationSubItem, error) {
+	if err := d.PushLimit(int64(length)); err != nil {
+		return nil, err
+	}
+	defer d.PopLimit()
+	v := &SOPClassCommonExtendedNegotiationSubItem{}
+	var err error
+	if v.SOPClassUID, err = readUIDWithLength(d); err != nil {
+		return nil, err
+	}
+	if v.ServiceClassUID, err = readUIDWithLength(d); err != nil {
+		return nil, err
+	}
+	relatedLen, err := d.ReadUInt16()
+	if err != nil {
+		return nil, err
+	}
+	if err := d.PushLimit(int64(relatedLen)); err != nil {
+		return nil, err
+	}
+	defer d.PopLimit()
+	for !d.IsLimitExhausted() {
+		uid, err := readUIDWithLength(d)
+		if err != nil {
+			return nil, err
+		}
+		v.RelatedGeneralSOPClassUIDs = append(v.RelatedGeneralSOPClassUIDs, uid)
+	}
+	return v, nil
+}
+
+func (v *SOPClassCommonExtendedNegotiationSubItem) Write(e *dicomio.Writer) error {
+	relatedLen := 0
+	for _, uid := range v.RelatedGeneralSOPClassUIDs {
+		relatedLen += 2 + len(uid)
+	}
+	length := 2 + len(v.SOPClassUID) + 2 + len(v.ServiceClassUID) + 2 + relatedLen
+	if length > 0xffff {
+		return fmt.Errorf("SOPClassCommonExtendedNegotiationSubItem: too long: %d bytes", length)
+	}
+	// The reserved byte in the header is the sub-item version, which is 0.
+	if err := encodeSubItemHeader(e, ItemTypeSOPClassCommonExtendedNegotiation, uint16(length)); err != nil {
+		return err
+	}
+	if err := writeUIDWithLength(e, v.SOPClassUID); err != nil {
+		return err
+	}
+	if err := writeUIDWithLength(e, v.ServiceClassUID); err != nil {
+		return err
+	}
+	if err := e.WriteUInt16(uint16(relatedLen)); err != nil {
+		return err
+	}
+	for _, uid := range v.RelatedGeneralSOPClassUIDs {
+		if err := writeUIDWithLength(e, uid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *SOPClassCommonExtendedNegotiationSubItem) String() string {
+	return fmt.Sprintf("SOPClassCommonExtendedNegotiation{sopclassuid: %v, serviceclassuid: %v, related: %v}",
+		v.SOPClassUID, v.ServiceClassUID, v.RelatedGeneralSOPClassUIDs)
+}
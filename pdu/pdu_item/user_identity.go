@@ -0,0 +1,163 @@
+package pdu_item
+
+//go:generate stringer -type UserIdentityType
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/suyashkumar/dicom/pkg/dicomio"
+)
+
+// UserIdentityType is the kind of credential carried in UserIdentitySubItem.
+type UserIdentityType byte
+
+// Possible values of UserIdentitySubItem.Type. PS3.7 Annex D.3.3.7.1
+const (
+	UserIdentityUsername         UserIdentityType = 1
+	UserIdentityUsernamePasscode UserIdentityType = 2
+	UserIdentityKerberos         UserIdentityType = 3
+	UserIdentitySAML             UserIdentityType = 4
+	UserIdentityJWT              UserIdentityType = 5
+)
+
+// PS3.7 Annex D.3.3.7.1
+type UserIdentitySubItem struct {
+	Type UserIdentityType
+	// If true, the requestor asks the acceptor to reply with
+	// UserIdentityResponseSubItem.
+	PositiveResponseRequested bool
+	// The username, Kerberos ticket, SAML assertion, or JWT, depending on
+	// Type.
+	PrimaryField []byte
+	// The passcode. Used only for UserIdentityUsernamePasscode.
+	SecondaryField []byte
+}
+
+func readBytes(d *dicomio.Reader, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(d, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func decodeUserIdentitySubItem(d *dicomio.Reader, length uint16) (*UserIdentitySubItem, error) {
+	if err := d.PushLimit(int64(length)); err != nil {
+		return nil, err
+	}
+	defer d.PopLimit()
+	v := &UserIdentitySubItem{}
+	identityType, err := d.ReadUInt8()
+	if err != nil {
+		return nil, err
+	}
+	v.Type = UserIdentityType(identityType)
+	positiveResponseRequested, err := d.ReadUInt8()
+	if err != nil {
+		return nil, err
+	}
+	v.PositiveResponseRequested = positiveResponseRequested != 0
+	primaryLength, err := d.ReadUInt16()
+	if err != nil {
+		return nil, err
+	}
+	if int64(primaryLength) > d.BytesLeftUntilLimit() {
+		return nil, fmt.Errorf("UserIdentitySubItem: primary field length %d exceeds item length %d", primaryLength, length)
+	}
+	if v.PrimaryField, err = readBytes(d, int(primaryLength)); err != nil {
+		return nil, err
+	}
+	secondaryLength, err := d.ReadUInt16()
+	if err != nil {
+		return nil, err
+	}
+	if int64(secondaryLength) > d.BytesLeftUntilLimit() {
+		return nil, fmt.Errorf("UserIdentitySubItem: secondary field length %d exceeds item length %d", secondaryLength, length)
+	}
+	if v.SecondaryField, err = readBytes(d, int(secondaryLength)); err != nil {
+		return nil, err
+	}
+	if int(length) != 6+len(v.PrimaryField)+len(v.SecondaryField) {
+		return nil, fmt.Errorf("UserIdentitySubItem: length mismatch: item length %d, primary %d, secondary %d",
+			length, len(v.PrimaryField), len(v.SecondaryField))
+	}
+	return v, nil
+}
+
+func (v *UserIdentitySubItem) Write(e *dicomio.Writer) error {
+	length := 6 + len(v.PrimaryField) + len(v.SecondaryField)
+	if length > 0xffff {
+		return fmt.Errorf("UserIdentitySubItem: too long: %d bytes", length)
+	}
+	if err := encodeSubItemHeader(e, ItemTypeUserIdentity, uint16(length)); err != nil {
+		return err
+	}
+	if err := e.WriteByte(byte(v.Type)); err != nil {
+		return err
+	}
+	var positiveResponseRequested byte
+	if v.PositiveResponseRequested {
+		positiveResponseRequested = 1
+	}
+	if err := e.WriteByte(positiveResponseRequested); err != nil {
+		return err
+	}
+	if err := e.WriteUInt16(uint16(len(v.PrimaryField))); err != nil {
+		return err
+	}
+	if err := e.WriteBytes(v.PrimaryField); err != nil {
+		return err
+	}
+	if err := e.WriteUInt16(uint16(len(v.SecondaryField))); err != nil {
+		return err
+	}
+	return e.WriteBytes(v.SecondaryField)
+}
+
+func (v *UserIdentitySubItem) String() string {
+	// Don't leak the credentials into logs.
+	return fmt.Sprintf("UserIdentity{type: %v, positiveresponse: %v, primary: %d bytes, secondary: %d bytes}",
+		v.Type, v.PositiveResponseRequested, len(v.PrimaryField), len(v.SecondaryField))
+}
+
+// PS3.7 Annex D.3.3.7.2
+type UserIdentityResponseSubItem struct {
+	// The Kerberos server ticket, SAML response, or JWT. Empty for the
+	// username-based identity types.
+	ServerResponse []byte
+}
+
+func decodeUserIdentityResponseSubItem(d *dicomio.Reader, length uint16) (*UserIdentityResponseSubItem, error) {
+	responseLength, err := d.ReadUInt16()
+	if err != nil {
+		return nil, err
+	}
+	if int(length) != 2+int(responseLength) {
+		return nil, fmt.Errorf("UserIdentityResponseSubItem: length mismatch: item length %d, response %d",
+			length, responseLength)
+	}
+	response, err := readBytes(d, int(responseLength))
+	if err != nil {
+		return nil, err
+	}
+	return &UserIdentityResponseSubItem{ServerResponse: response}, nil
+}
+
+func (v *UserIdentityResponseSubItem) Write(e *dicomio.Writer) error {
+	length := 2 + len(v.ServerResponse)
+	if length > 0xffff {
+		return fmt.Errorf("UserIdentityResponseSubItem: too long: %d bytes", length)
+	}
+	if err := encodeSubItemHeader(e, ItemTypeUserIdentityResponse, uint16(length)); err != nil {
+		return err
+	}
+	if err := e.WriteUInt16(uint16(len(v.ServerResponse))); err != nil {
+		return err
+	}
+	return e.WriteBytes(v.ServerResponse)
+}
+
+func (v *UserIdentityResponseSubItem) String() string {
+	return fmt.Sprintf("UserIdentityResponse{response: %d bytes}", len(v.ServerResponse))
+}
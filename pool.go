@@ -0,0 +1,315 @@
+package netdicom
+
+// This file implements a pool of service-user associations.
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/go-dicom/dicomlog"
+	"github.com/grailbio/go-dicom/dicomuid"
+)
+
+// Default values of PoolParams.
+const (
+	DefaultPoolMaxIdle     = 2
+	DefaultPoolIdleTimeout = time.Minute
+)
+
+// PoolParams configures a Pool.
+type PoolParams struct {
+	// MaxIdle is the number of idle associations kept for each (remote
+	// address, ServiceUserParams) pair; see Pool. Extra
+	// associations are released when they are returned to the pool. Zero
+	// means DefaultPoolMaxIdle.
+	MaxIdle int
+
+	// IdleTimeout is how long an association may stay unused in the pool
+	// before it is released. Zero means DefaultPoolIdleTimeout.
+	IdleTimeout time.Duration
+
+	// MaxOperations retires an association once it has run this many DIMSE
+	// operations. Zero means no limit.
+	MaxOperations int
+
+	// HealthCheckAfter makes Get check an association that has been idle for
+	// longer than this with C-ECHO before handing it out. Associations that
+	// fail the check are released and replaced. The SOP classes must
+	// include the verification SOP class for the check to run. Zero
+	// disables the check; associations that the peer has released or
+	// aborted are replaced regardless.
+	HealthCheckAfter time.Duration
+}
+
+// Pool keeps associations with remote AEs open and hands them out, saving the
+// handshake when the same peer is contacted repeatedly. Associations are keyed
+// by the remote address, the AE titles, the SOP classes, and the rest of the
+// ServiceUserParams, so Get only returns an association that was established
+// with equivalent parameters. E.g., callers with different UserIdentity or
+// TLSConfig values never share an association. TLSConfig, Dialer and
+// RetryPolicy are compared by identity, so reuse the same values to share
+// associations.
+//
+// Pool is safe for concurrent use. An association is used by one caller at a
+// time; concurrent Gets for the same peer open more associations.
+type Pool struct {
+	params PoolParams
+
+	mu     sync.Mutex
+	idle   map[poolKey][]*poolEntry // guarded by mu. Most recently used last.
+	inUse  map[*ServiceUser]*poolEntry
+	closed bool
+	doneCh chan struct{} // closed by Close to stop the reaper.
+}
+
+type poolKey struct {
+	serverAddr     string
+	calledAETitle  string
+	callingAETitle string
+	sopClasses     string // sorted, comma-separated.
+	// Digest of the other parameters. Hashed so that the key doesn't hold
+	// credentials.
+	paramsDigest [sha256.Size]byte
+}
+
+type poolEntry struct {
+	key      poolKey
+	su       *ServiceUser
+	lastUsed time.Time
+}
+
+var errPoolClosed = errors.New("dicom: pool closed")
+
+// NewPool creates an empty pool. Call Close to release the associations when
+// the pool is no longer needed.
+func NewPool(params PoolParams) *Pool {
+	if params.MaxIdle <= 0 {
+		params.MaxIdle = DefaultPoolMaxIdle
+	}
+	if params.IdleTimeout <= 0 {
+		params.IdleTimeout = DefaultPoolIdleTimeout
+	}
+	p := &Pool{
+		params: params,
+		idle:   make(map[poolKey][]*poolEntry),
+		inUse:  make(map[*ServiceUser]*poolEntry),
+		doneCh: make(chan struct{}),
+	}
+	go p.reap()
+	return p
+}
+
+func newPoolKey(serverAddr string, params ServiceUserParams) poolKey {
+	sopClasses := append([]string{}, params.SOPClasses...)
+	sort.Strings(sopClasses)
+	return poolKey{
+		serverAddr:     serverAddr,
+		calledAETitle:  params.CalledAETitle,
+		callingAETitle: params.CallingAETitle,
+		sopClasses:     strings.Join(sopClasses, ","),
+		paramsDigest:   digestPoolParams(params),
+	}
+}
+
+// Hash the parameters not covered by the other fields of poolKey. Pointer
+// and function parameters are hashed by identity.
+func digestPoolParams(params ServiceUserParams) [sha256.Size]byte {
+	h := sha256.New()
+	fmt.Fprintf(h, "%q %v %d %d %d %p %p %p %v %v %v %v\n",
+		params.TransferSyntaxes, params.ContextPerTransferSyntax,
+		params.MaxOpsInvoked, params.MaxPDUSize, params.MaxSendPDUSize,
+		params.Dialer, params.TLSConfig, params.RetryPolicy,
+		params.ConnectTimeout, params.ARTIMTimeout, params.DIMSETimeout, params.IdleTimeout)
+	if id := params.UserIdentity; id != nil {
+		fmt.Fprintf(h, "identity %d %v %q %q\n", id.Type, id.PositiveResponseRequested, id.PrimaryField, id.SecondaryField)
+	}
+	for _, n := range params.SOPClassExtendedNegotiation {
+		fmt.Fprintf(h, "extended %q %q\n", n.SOPClassUID, n.ServiceClassApplicationInformation)
+	}
+	for _, n := range params.SOPClassCommonExtendedNegotiation {
+		fmt.Fprintf(h, "common %q %q %q\n", n.SOPClassUID, n.ServiceClassUID, n.RelatedGeneralSOPClassUIDs)
+	}
+	var digest [sha256.Size]byte
+	h.Sum(digest[:0])
+	return digest
+}
+
+// Get returns an established association with "serverAddr" for "params",
+// either an idle one from the pool or a new one. The caller must return it
+// with Put, and must not call Release on it.
+//
+// ctx bounds the handshake of a new association and the health check.
+func (p *Pool) Get(ctx context.Context, serverAddr string, params ServiceUserParams) (*ServiceUser, error) {
+	key := newPoolKey(serverAddr, params)
+	for {
+		e, err := p.popIdle(key)
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			break
+		}
+		if !p.healthy(ctx, e) {
+			e.su.Release()
+			continue
+		}
+		p.markInUse(e)
+		return e.su, nil
+	}
+	su, err := NewServiceUser(params)
+	if err != nil {
+		return nil, err
+	}
+	if err := su.ConnectContext(ctx, serverAddr); err != nil {
+		su.Release()
+		return nil, err
+	}
+	dicomlog.Vprintf(1, "dicom.pool: Opened association %s to %s", su.label, serverAddr)
+	p.markInUse(&poolEntry{key: key, su: su})
+	return su, nil
+}
+
+// Take the most recently used idle association for "key". Returns nil if
+// there is none.
+func (p *Pool) popIdle(key poolKey) (*poolEntry, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return nil, errPoolClosed
+	}
+	entries := p.idle[key]
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	e := entries[len(entries)-1]
+	entries[len(entries)-1] = nil
+	if len(entries) == 1 {
+		delete(p.idle, key)
+	} else {
+		p.idle[key] = entries[:len(entries)-1]
+	}
+	return e, nil
+}
+
+func (p *Pool) markInUse(e *poolEntry) {
+	p.mu.Lock()
+	p.inUse[e.su] = e
+	p.mu.Unlock()
+}
+
+// Report whether an idle association can be handed out.
+func (p *Pool) healthy(ctx context.Context, e *poolEntry) bool {
+	if !p.reusable(e) {
+		return false
+	}
+	if p.params.HealthCheckAfter <= 0 || time.Since(e.lastUsed) < p.params.HealthCheckAfter {
+		return true
+	}
+	if _, err := e.su.cm.lookupByAbstractSyntaxUID(dicomuid.VerificationSOPClass); err != nil {
+		return true
+	}
+	if err := e.su.CEchoContext(ctx); err != nil {
+		dicomlog.Vprintf(0, "dicom.pool: Association %s failed the health check: %v", e.su.label, err)
+		return false
+	}
+	return true
+}
+
+// Report whether the association is still active and within its operation
+// budget.
+func (p *Pool) reusable(e *poolEntry) bool {
+	if e.su.getStatus() != serviceUserAssociationActive {
+		dicomlog.Vprintf(1, "dicom.pool: Association %s has been closed by the peer", e.su.label)
+		return false
+	}
+	if p.params.MaxOperations > 0 && e.su.numOperations() >= p.params.MaxOperations {
+		dicomlog.Vprintf(1, "dicom.pool: Retiring association %s after %d operations", e.su.label, e.su.numOperations())
+		return false
+	}
+	return true
+}
+
+// Put returns an association obtained from Get to the pool. The association
+// is released instead if it has ended, e.g., because of a timeout or an abort,
+// if it has run MaxOperations operations, or if the pool already holds MaxIdle
+// idle associations for the same peer.
+func (p *Pool) Put(su *ServiceUser) {
+	p.mu.Lock()
+	e, ok := p.inUse[su]
+	if !ok {
+		p.mu.Unlock()
+		dicomlog.Vprintf(0, "dicom.pool: Put of an association %s that is not from the pool", su.label)
+		return
+	}
+	delete(p.inUse, su)
+	release := p.closed || len(p.idle[e.key]) >= p.params.MaxIdle || !p.reusable(e)
+	if !release {
+		e.lastUsed = time.Now()
+		p.idle[e.key] = append(p.idle[e.key], e)
+	}
+	p.mu.Unlock()
+	if release {
+		su.Release()
+	}
+}
+
+// Release the associations that have been idle for longer than IdleTimeout.
+func (p *Pool) reap() {
+	ticker := time.NewTicker(p.params.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.doneCh:
+			return
+		case <-ticker.C:
+		}
+		var expired []*poolEntry
+		p.mu.Lock()
+		for key, entries := range p.idle {
+			var kept []*poolEntry
+			for _, e := range entries {
+				if time.Since(e.lastUsed) >= p.params.IdleTimeout {
+					expired = append(expired, e)
+				} else {
+					kept = append(kept, e)
+				}
+			}
+			if len(kept) == 0 {
+				delete(p.idle, key)
+			} else {
+				p.idle[key] = kept
+			}
+		}
+		p.mu.Unlock()
+		for _, e := range expired {
+			dicomlog.Vprintf(1, "dicom.pool: Releasing idle association %s", e.su.label)
+			e.su.Release()
+		}
+	}
+}
+
+// Close releases the idle associations. Associations in use are released when
+// they are returned with Put. Get fails after Close.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	p.closed = true
+	close(p.doneCh)
+	idle := p.idle
+	p.idle = make(map[poolKey][]*poolEntry)
+	p.mu.Unlock()
+	for _, entries := range idle {
+		for _, e := range entries {
+			e.su.Release()
+		}
+	}
+}
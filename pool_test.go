@@ -0,0 +1,166 @@
+package netdicom
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/algm/go-netdicom/pdu"
+	"github.com/algm/go-netdicom/pdu/pdu_item"
+	"github.com/algm/go-netdicom/sopclass"
+	"github.com/stretchr/testify/require"
+)
+
+// Start a provider that counts the associations it accepts.
+func startCountingProvider(t *testing.T, params ServiceProviderParams) (*ServiceProvider, func() int) {
+	var mu sync.Mutex
+	n := 0
+	params.OnAssociationRequest = func(req AssociationRequest) *pdu.AAssociateRj {
+		mu.Lock()
+		n++
+		mu.Unlock()
+		return nil
+	}
+	sp := startTestProvider(t, params)
+	return sp, func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return n
+	}
+}
+
+func TestPoolReuse(t *testing.T) {
+	sp, numAssociations := startCountingProvider(t, ServiceProviderParams{})
+	pool := NewPool(PoolParams{MaxOperations: 3})
+	defer pool.Close()
+	ctx := context.Background()
+	params := ServiceUserParams{SOPClasses: sopclass.VerificationClasses}
+
+	var first *ServiceUser
+	for i := 0; i < 3; i++ {
+		su, err := pool.Get(ctx, sp.ListenAddr().String(), params)
+		require.NoError(t, err)
+		if first == nil {
+			first = su
+		}
+		require.Equal(t, first, su)
+		require.NoError(t, su.CEcho())
+		pool.Put(su)
+	}
+	require.Equal(t, 1, numAssociations())
+
+	// The first association has run MaxOperations operations.
+	su, err := pool.Get(ctx, sp.ListenAddr().String(), params)
+	require.NoError(t, err)
+	require.NotEqual(t, first, su)
+	require.NoError(t, su.CEcho())
+	pool.Put(su)
+	require.Equal(t, 2, numAssociations())
+
+	// Different parameters get a different association.
+	su, err = pool.Get(ctx, sp.ListenAddr().String(), ServiceUserParams{
+		CallingAETitle: "OTHER",
+		SOPClasses:     sopclass.VerificationClasses,
+	})
+	require.NoError(t, err)
+	require.NoError(t, su.CEcho())
+	pool.Put(su)
+	require.Equal(t, 3, numAssociations())
+}
+
+func TestPoolReplacesClosedAssociation(t *testing.T) {
+	sp, numAssociations := startCountingProvider(t, ServiceProviderParams{
+		IdleTimeout: 100 * time.Millisecond,
+	})
+	pool := NewPool(PoolParams{HealthCheckAfter: time.Millisecond})
+	defer pool.Close()
+	ctx := context.Background()
+	params := ServiceUserParams{SOPClasses: sopclass.VerificationClasses}
+
+	su, err := pool.Get(ctx, sp.ListenAddr().String(), params)
+	require.NoError(t, err)
+	require.NoError(t, su.CEcho())
+	pool.Put(su)
+	// The server aborts the idle association.
+	time.Sleep(300 * time.Millisecond)
+
+	su2, err := pool.Get(ctx, sp.ListenAddr().String(), params)
+	require.NoError(t, err)
+	require.NotEqual(t, su, su2)
+	require.NoError(t, su2.CEcho())
+	pool.Put(su2)
+	require.Equal(t, 2, numAssociations())
+}
+
+func TestPoolIdleTimeoutAndClose(t *testing.T) {
+	sp, numAssociations := startCountingProvider(t, ServiceProviderParams{})
+	pool := NewPool(PoolParams{IdleTimeout: 50 * time.Millisecond})
+	ctx := context.Background()
+	params := ServiceUserParams{SOPClasses: sopclass.VerificationClasses}
+
+	su, err := pool.Get(ctx, sp.ListenAddr().String(), params)
+	require.NoError(t, err)
+	pool.Put(su)
+	require.Eventually(t, func() bool {
+		return su.getStatus() == serviceUserClosed
+	}, 5*time.Second, 10*time.Millisecond)
+
+	su, err = pool.Get(ctx, sp.ListenAddr().String(), params)
+	require.NoError(t, err)
+	require.NoError(t, su.CEcho())
+	require.Equal(t, 2, numAssociations())
+
+	pool.Close()
+	_, err = pool.Get(ctx, sp.ListenAddr().String(), params)
+	require.Error(t, err)
+	// An association returned after Close is released.
+	pool.Put(su)
+	require.True(t, su.getStatus() == serviceUserClosed)
+}
+
+func TestPoolKeysOnUserIdentity(t *testing.T) {
+	var mu sync.Mutex
+	var users []string
+	sp := startTestProvider(t, ServiceProviderParams{
+		AuthenticateUser: func(req AssociationRequest, identity *pdu_item.UserIdentitySubItem) ([]byte, error) {
+			mu.Lock()
+			users = append(users, string(identity.PrimaryField))
+			mu.Unlock()
+			return nil, nil
+		},
+	})
+	pool := NewPool(PoolParams{})
+	defer pool.Close()
+	ctx := context.Background()
+	paramsFor := func(user string) ServiceUserParams {
+		return ServiceUserParams{
+			SOPClasses: sopclass.VerificationClasses,
+			UserIdentity: &pdu_item.UserIdentitySubItem{
+				Type:           pdu_item.UserIdentityUsernamePasscode,
+				PrimaryField:   []byte(user),
+				SecondaryField: []byte("passcode"),
+			},
+		}
+	}
+
+	alice, err := pool.Get(ctx, sp.ListenAddr().String(), paramsFor("alice"))
+	require.NoError(t, err)
+	require.NoError(t, alice.CEcho())
+	pool.Put(alice)
+
+	bob, err := pool.Get(ctx, sp.ListenAddr().String(), paramsFor("bob"))
+	require.NoError(t, err)
+	require.NotEqual(t, alice, bob)
+	require.NoError(t, bob.CEcho())
+	pool.Put(bob)
+
+	// Equal parameters share the association.
+	su, err := pool.Get(ctx, sp.ListenAddr().String(), paramsFor("alice"))
+	require.NoError(t, err)
+	require.Equal(t, alice, su)
+	pool.Put(su)
+	mu.Lock()
+	require.Equal(t, []string{"alice", "bob"}, users)
+	mu.Unlock()
+}
@@ -0,0 +1,144 @@
+package netdicom
+
+// This file implements the retry policy for C-STORE.
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/algm/go-netdicom/dimse"
+	"github.com/grailbio/go-dicom/dicomlog"
+)
+
+// Default values of RetryPolicy.
+const (
+	DefaultRetryInitialBackoff = 200 * time.Millisecond
+	DefaultRetryMaxBackoff     = 10 * time.Second
+	DefaultRetryMultiplier     = 2.0
+)
+
+// RetryPolicy controls how a failed C-STORE is retried. It is used by
+// ServiceUser.CStore, through ServiceUserParams.RetryPolicy, and by the C-STORE
+// sub-operations of C-MOVE, through ServiceProviderParams.CMoveRetryPolicy.
+//
+// Retries wait for an exponentially growing backoff. If the association was
+// lost, e.g., because the server aborted it or a timeout expired, a new one is
+// established before retrying.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first
+	// one. Values below 2 disable retries.
+	MaxAttempts int
+
+	// InitialBackoff is the wait before the first retry. Zero means
+	// DefaultRetryInitialBackoff.
+	InitialBackoff time.Duration
+
+	// MaxBackoff caps the wait between attempts. Zero means
+	// DefaultRetryMaxBackoff.
+	MaxBackoff time.Duration
+
+	// Multiplier is the factor applied to the backoff after every retry.
+	// Values below 1 mean DefaultRetryMultiplier.
+	Multiplier float64
+
+	// Jitter randomizes each wait by up to this fraction of it, e.g., 0.2
+	// waits between 80% and 120% of the backoff. It keeps clients that failed
+	// together from retrying together.
+	Jitter float64
+
+	// Retryable reports whether an attempt that failed with "err" should be
+	// retried. Nil means IsRetryable.
+	Retryable func(err error) bool
+}
+
+// IsRetryable reports whether a C-STORE that failed with "err" may succeed if
+// retried. Lost associations, timeouts, network errors, transient association
+// rejections, and "refused: out of resources" statuses (A7xx) are retryable.
+// Other failure statuses, e.g., "data set does not match SOP class" (A9xx),
+// are not, and neither is the caller's context being done.
+func IsRetryable(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return isRetryableStatus(statusErr.Status.Status)
+	}
+	var rejected *AssociationRejectedError
+	if errors.As(err, &rejected) {
+		return rejected.Transient()
+	}
+	var aborted *AssociationAbortedError
+	var timeoutErr *TimeoutError
+	var netErr net.Error
+	return errors.As(err, &aborted) ||
+		errors.As(err, &timeoutErr) ||
+		errors.As(err, &netErr) ||
+		errors.Is(err, errConnectionClosed)
+}
+
+// Report whether a C-STORE failure status is transient. P3.4 B.2.3
+func isRetryableStatus(status dimse.StatusCode) bool {
+	return status >= 0xa700 && status <= 0xa7ff
+}
+
+// Report whether another attempt should follow attempt number "attempt",
+// which failed with "err". p may be nil.
+func (p *RetryPolicy) shouldRetry(attempt int, err error) bool {
+	if p == nil || attempt >= p.MaxAttempts {
+		return false
+	}
+	if p.Retryable != nil {
+		return p.Retryable(err)
+	}
+	return IsRetryable(err)
+}
+
+// The wait after attempt number "attempt" (1-based) fails.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	initial, max, multiplier := p.InitialBackoff, p.MaxBackoff, p.Multiplier
+	if initial <= 0 {
+		initial = DefaultRetryInitialBackoff
+	}
+	if max <= 0 {
+		max = DefaultRetryMaxBackoff
+	}
+	if multiplier < 1 {
+		multiplier = DefaultRetryMultiplier
+	}
+	backoff := float64(initial)
+	for i := 1; i < attempt && backoff < float64(max); i++ {
+		backoff *= multiplier
+	}
+	if backoff > float64(max) {
+		backoff = float64(max)
+	}
+	if p.Jitter > 0 {
+		backoff *= 1 + p.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(backoff)
+}
+
+// Run "op" until it succeeds, fails with an error that isn't retryable, or
+// runs out of attempts. "op" is passed the 1-based attempt number. Returns the
+// error of the last attempt, or ctx.Err() if ctx is done while waiting.
+func (p *RetryPolicy) run(ctx context.Context, label string, op func(attempt int) error) error {
+	for attempt := 1; ; attempt++ {
+		err := op(attempt)
+		if err == nil || !p.shouldRetry(attempt, err) {
+			return err
+		}
+		wait := p.backoff(attempt)
+		dicomlog.Vprintf(0, "dicom.retry(%s): Attempt %d failed: %v; retrying in %v", label, attempt, err, wait)
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		}
+	}
+}
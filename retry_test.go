@@ -0,0 +1,242 @@
+package netdicom
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/algm/go-netdicom/dimse"
+	"github.com/algm/go-netdicom/pdu"
+	"github.com/algm/go-netdicom/sopclass"
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsRetryable(t *testing.T) {
+	for _, test := range []struct {
+		err       error
+		retryable bool
+	}{
+		{&StatusError{Op: "C-STORE", Status: dimse.Status{Status: dimse.CStoreOutOfResources}}, true},
+		{&StatusError{Op: "C-STORE", Status: dimse.Status{Status: dimse.CStoreDataSetDoesNotMatchSOPClass}}, false},
+		{&TimeoutError{Op: "C-STORE response"}, true},
+		{&AssociationAbortedError{}, true},
+		{&AssociationRejectedError{Result: pdu.ResultRejectedTransient}, true},
+		{&AssociationRejectedError{Result: pdu.ResultRejectedPermanent}, false},
+		{fmt.Errorf("%w while waiting for C-STORE response", errConnectionClosed), true},
+		{&ProtocolError{Err: fmt.Errorf("bad PDU")}, false},
+		{context.Canceled, false},
+	} {
+		require.Equal(t, test.retryable, IsRetryable(test.err), "%v", test.err)
+	}
+}
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	p := &RetryPolicy{InitialBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	require.Equal(t, 100*time.Millisecond, p.backoff(1))
+	require.Equal(t, 200*time.Millisecond, p.backoff(2))
+	require.Equal(t, 800*time.Millisecond, p.backoff(4))
+	require.Equal(t, time.Second, p.backoff(10))
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		wait := p.backoff(1)
+		require.True(t, wait >= 50*time.Millisecond && wait <= 150*time.Millisecond, "%v", wait)
+	}
+}
+
+func TestCStoreRetry(t *testing.T) {
+	ds := mustReadTestDICOMFile("testdata/IM-0001-0003.dcm")
+	var mu sync.Mutex
+	var statuses []dimse.StatusCode
+	sp := startTestProvider(t, ServiceProviderParams{
+		CStore: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string,
+			dataReader io.Reader, dataSize int64) dimse.Status {
+			mu.Lock()
+			defer mu.Unlock()
+			if len(statuses) == 0 {
+				return dimse.Success
+			}
+			status := statuses[0]
+			statuses = statuses[1:]
+			return dimse.Status{Status: status}
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.StorageClasses,
+		TransferSyntaxes: testTransferSyntaxes,
+		RetryPolicy:      &RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	mu.Lock()
+	statuses = []dimse.StatusCode{dimse.CStoreOutOfResources, dimse.CStoreOutOfResources}
+	mu.Unlock()
+	require.NoError(t, su.CStore(ds))
+
+	mu.Lock()
+	statuses = []dimse.StatusCode{dimse.CStoreOutOfResources, dimse.CStoreOutOfResources, dimse.CStoreOutOfResources}
+	mu.Unlock()
+	var statusErr *StatusError
+	require.ErrorAs(t, su.CStore(ds), &statusErr)
+	require.Equal(t, dimse.CStoreOutOfResources, statusErr.Status.Status)
+
+	// Not retryable.
+	mu.Lock()
+	statuses = []dimse.StatusCode{dimse.CStoreDataSetDoesNotMatchSOPClass}
+	mu.Unlock()
+	require.ErrorAs(t, su.CStore(ds), &statusErr)
+	require.Equal(t, dimse.CStoreDataSetDoesNotMatchSOPClass, statusErr.Status.Status)
+	// 3 attempts, 3 attempts, and a single attempt.
+	require.Equal(t, 7, su.numOperations())
+}
+
+func TestCStoreRetryReconnects(t *testing.T) {
+	ds := mustReadTestDICOMFile("testdata/IM-0001-0003.dcm")
+	var mu sync.Mutex
+	calls := 0
+	sp, numAssociations := startCountingProvider(t, ServiceProviderParams{
+		CStore: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string,
+			dataReader io.Reader, dataSize int64) dimse.Status {
+			mu.Lock()
+			calls++
+			first := calls == 1
+			mu.Unlock()
+			if first {
+				// Stall until the client times out and aborts.
+				<-ctx.Done()
+			}
+			return dimse.Success
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.StorageClasses,
+		TransferSyntaxes: testTransferSyntaxes,
+		DIMSETimeout:     100 * time.Millisecond,
+		RetryPolicy:      &RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	require.NoError(t, su.CStore(ds))
+	require.Equal(t, 2, numAssociations())
+	// The new association is usable.
+	require.NoError(t, su.CStore(ds))
+}
+
+// Operations on a reconnected association fail, rather than hang, when that
+// association is lost too.
+func TestReconnectedAssociationLost(t *testing.T) {
+	ds := mustReadTestDICOMFile("testdata/IM-0001-0003.dcm")
+	var mu sync.Mutex
+	var conns []net.Conn
+	connAt := func(i int) net.Conn {
+		mu.Lock()
+		defer mu.Unlock()
+		return conns[i]
+	}
+	calls := 0
+	echoStarted := make(chan struct{})
+	sp, numAssociations := startCountingProvider(t, ServiceProviderParams{
+		CStore: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string,
+			dataReader io.Reader, dataSize int64) dimse.Status {
+			mu.Lock()
+			calls++
+			first := calls == 1
+			mu.Unlock()
+			if first {
+				// Drop the first association before responding.
+				connAt(0).Close()
+			}
+			return dimse.Success
+		},
+		CEcho: func(ctx context.Context, conn ConnectionState) dimse.Status {
+			close(echoStarted)
+			<-ctx.Done()
+			return dimse.Success
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       append(append([]string{}, sopclass.StorageClasses...), sopclass.VerificationClasses...),
+		TransferSyntaxes: testTransferSyntaxes,
+		RetryPolicy:      &RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond},
+		Dialer: func(ctx context.Context, network, address string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, address)
+			if err == nil {
+				mu.Lock()
+				conns = append(conns, conn)
+				mu.Unlock()
+			}
+			return conn, err
+		},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	require.NoError(t, su.CStore(ds))
+	require.Equal(t, 2, numAssociations())
+
+	echoErr := make(chan error, 1)
+	go func() { echoErr <- su.CEcho() }()
+	<-echoStarted
+	connAt(1).Close()
+	select {
+	case err := <-echoErr:
+		require.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("C-ECHO did not return after the reconnected association was lost")
+	}
+}
+
+func TestCMoveRetry(t *testing.T) {
+	ds := mustReadTestDICOMFile("testdata/IM-0001-0003.dcm")
+	var mu sync.Mutex
+	calls := 0
+	dest := startTestProvider(t, ServiceProviderParams{
+		AETitle: "DEST",
+		CStore: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string,
+			dataReader io.Reader, dataSize int64) dimse.Status {
+			mu.Lock()
+			defer mu.Unlock()
+			calls++
+			if calls == 1 {
+				return dimse.Status{Status: dimse.CStoreOutOfResources}
+			}
+			return dimse.Success
+		},
+	})
+	sp := startTestProvider(t, ServiceProviderParams{
+		RemoteAEs:        map[string]string{"DEST": dest.ListenAddr().String()},
+		CMoveRetryPolicy: &RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond},
+		CMove: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CMoveResult) {
+			ch <- CMoveResult{Path: "a.dcm", DataSet: ds}
+			close(ch)
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.QRMoveClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	filter := []*dicom.Element{dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3")}
+	var final CMoveProgress
+	for p := range su.CMove(context.Background(), QRLevelStudy, filter, "DEST") {
+		final = p
+	}
+	require.NoError(t, final.Err)
+	require.Equal(t, dimse.StatusSuccess, final.Status.Status)
+	require.Equal(t, 1, final.Completed)
+	require.Equal(t, 0, final.Failed)
+	mu.Lock()
+	require.Equal(t, 2, calls)
+	mu.Unlock()
+}
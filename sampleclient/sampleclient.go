@@ -1,7 +1,9 @@
-// A sample program for issuing C-STORE or C-FIND to a remote server.
+// A sample program for issuing C-STORE, C-FIND, C-GET, or C-MOVE to a remote
+// server.
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
 
@@ -19,8 +21,9 @@ var (
 	remoteAETitleFlag = flag.String("remote-ae-title", "testserver", "AE title of the server")
 	findFlag          = flag.Bool("find", false, "Issue a C-FIND.")
 	getFlag           = flag.Bool("get", false, "Issue a C-GET.")
-	seriesFlag        = flag.String("series", "", "Study series UID to retrieve in C-{FIND,GET}.")
-	studyFlag         = flag.String("study", "", "Study instance UID to retrieve in C-{FIND,GET}.")
+	moveFlag          = flag.String("move", "", "If set, issue a C-MOVE to send the datasets to this AE title.")
+	seriesFlag        = flag.String("series", "", "Study series UID to retrieve in C-{FIND,GET,MOVE}.")
+	studyFlag         = flag.String("study", "", "Study instance UID to retrieve in C-{FIND,GET,MOVE}.")
 )
 
 func newServiceUser(sopClasses []string) *netdicom.ServiceUser {
@@ -93,6 +96,23 @@ func cGet() {
 	log.Printf("C-GET finished: %v", err)
 }
 
+func cMove(destinationAE string) {
+	su := newServiceUser(sopclass.QRMoveClasses)
+	defer su.Release()
+	qrLevel, args := generateCFindElements()
+	for progress := range su.CMove(context.Background(), qrLevel, args, destinationAE) {
+		if progress.Err != nil {
+			log.Printf("C-MOVE error: %v", progress.Err)
+			continue
+		}
+		log.Printf("C-MOVE progress: status=%v remaining=%d completed=%d failed=%d warning=%d",
+			progress.Status.Status, progress.Remaining, progress.Completed, progress.Failed, progress.Warning)
+		for _, uid := range progress.FailedSOPInstanceUIDs {
+			log.Printf("C-MOVE failed for %v", uid)
+		}
+	}
+}
+
 func cFind() {
 	su := newServiceUser(sopclass.QRFindClasses)
 	defer su.Release()
@@ -117,7 +137,9 @@ func main() {
 		cFind()
 	} else if *getFlag {
 		cGet()
+	} else if *moveFlag != "" {
+		cMove(*moveFlag)
 	} else {
-		log.Panic("Either -store, -get, or -find must be set")
+		log.Panic("Either -store, -get, -move, or -find must be set")
 	}
 }
@@ -153,6 +153,7 @@ func (ss *server) findMatchingFiles(filters []*dicom.Element) ([]filterMatch, er
 }
 
 func (ss *server) onCFind(
+	ctx context.Context,
 	transferSyntaxUID string,
 	sopClassUID string,
 	filters []*dicom.Element,
@@ -170,6 +171,10 @@ func (ss *server) onCFind(
 		ch <- netdicom.CFindResult{Err: err}
 	} else {
 		for _, match := range matches {
+			if ctx.Err() != nil {
+				log.Printf("C-FIND: cancelled")
+				break
+			}
 			log.Printf("C-FIND resp %s: %v", match.path, match.elems)
 			ch <- netdicom.CFindResult{Elements: match.elems}
 		}
@@ -178,6 +183,7 @@ func (ss *server) onCFind(
 }
 
 func (ss *server) onCMoveOrCGet(
+	ctx context.Context,
 	transferSyntaxUID string,
 	sopClassUID string,
 	filters []*dicom.Element,
@@ -195,6 +201,10 @@ func (ss *server) onCMoveOrCGet(
 		ch <- netdicom.CMoveResult{Err: err}
 	} else {
 		for i, match := range matches {
+			if ctx.Err() != nil {
+				log.Printf("C-MOVE: cancelled")
+				break
+			}
 			log.Printf("C-MOVE resp %d %s: %v", i, match.path, match.elems)
 			// Read the file; the one in ss.datasets lack the PixelData.
 			ds, err := dicom.ReadDataSetFromFile(match.path, dicom.ReadOptions{})
@@ -333,21 +343,21 @@ func main() {
 	params := netdicom.ServiceProviderParams{
 		AETitle:   *aeFlag,
 		RemoteAEs: remoteAEs,
-		CEcho: func(connState netdicom.ConnectionState) dimse.Status {
+		CEcho: func(ctx context.Context, connState netdicom.ConnectionState) dimse.Status {
 			log.Printf("Received C-ECHO")
 			return dimse.Success
 		},
-		CFind: func(connState netdicom.ConnectionState, transferSyntaxUID string, sopClassUID string,
+		CFind: func(ctx context.Context, connState netdicom.ConnectionState, transferSyntaxUID string, sopClassUID string,
 			filter []*dicom.Element, ch chan netdicom.CFindResult) {
-			ss.onCFind(transferSyntaxUID, sopClassUID, filter, ch)
+			ss.onCFind(ctx, transferSyntaxUID, sopClassUID, filter, ch)
 		},
-		CMove: func(connState netdicom.ConnectionState, transferSyntaxUID string, sopClassUID string,
+		CMove: func(ctx context.Context, connState netdicom.ConnectionState, transferSyntaxUID string, sopClassUID string,
 			filter []*dicom.Element, ch chan netdicom.CMoveResult) {
-			ss.onCMoveOrCGet(transferSyntaxUID, sopClassUID, filter, ch)
+			ss.onCMoveOrCGet(ctx, transferSyntaxUID, sopClassUID, filter, ch)
 		},
-		CGet: func(connState netdicom.ConnectionState, transferSyntaxUID string, sopClassUID string,
+		CGet: func(ctx context.Context, connState netdicom.ConnectionState, transferSyntaxUID string, sopClassUID string,
 			filter []*dicom.Element, ch chan netdicom.CMoveResult) {
-			ss.onCMoveOrCGet(transferSyntaxUID, sopClassUID, filter, ch)
+			ss.onCMoveOrCGet(ctx, transferSyntaxUID, sopClassUID, filter, ch)
 		},
 		CStore: func(ctx context.Context, connState netdicom.ConnectionState, transferSyntaxUID string,
 			sopClassUID string,
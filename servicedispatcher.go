@@ -1,8 +1,10 @@
 package netdicom
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/algm/go-netdicom/dimse"
 	"github.com/grailbio/go-dicom/dicomlog"
@@ -13,6 +15,9 @@ type serviceDispatcher struct {
 	label      string          // for logging.
 	downcallCh chan stateEvent // for sending PDUs to the statemachine.
 
+	// Parent of the contexts of the commands started by the peer.
+	ctx context.Context
+
 	mu sync.Mutex
 
 	// Set of active DIMSE commands running. Keys are message IDs.
@@ -39,9 +44,19 @@ type serviceCommandState struct {
 
 	// upcallCh streams command+data for this messageID.
 	upcallCh chan upcallEvent
+	// Set once close has closed upcallCh.
+	closed bool // guarded by disp.mu
 
 	// streamingReader holds the DimseCommand when server decides to stream large datasets.
 	streamingReader *dimse.DimseCommand
+
+	// For a command started by the peer, ctx is cancelled when the peer sends
+	// C-CANCEL-RQ for it, or when the association ends.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// For a command started by us, set once we have sent C-CANCEL-RQ for it.
+	cancelSent bool
 }
 
 // Send a command+data combo to the remote peer. data may be nil.
@@ -52,9 +67,9 @@ func (cs *serviceCommandState) sendMessage(cmd dimse.Message, data []byte) {
 		dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Sending DIMSE message: %v %v", cs.disp.label, cmd, cs.disp)
 	}
 	payload := &stateEventDIMSEPayload{
-		abstractSyntaxName: cs.context.abstractSyntaxUID,
-		command:            cmd,
-		data:               data,
+		contextID: cs.context.contextID,
+		command:   cmd,
+		data:      data,
 	}
 	cs.disp.downcallCh <- stateEvent{
 		event:        evt09,
@@ -64,10 +79,34 @@ func (cs *serviceCommandState) sendMessage(cmd dimse.Message, data []byte) {
 	}
 }
 
+// Wait for the next message on upcallCh, for at most "timeout" (forever if
+// zero). "op" names the awaited message in errors. Returns a *TimeoutError on
+// timeout, an error wrapping errConnectionClosed if upcallCh is closed, and
+// ctx.Err() if ctx is done first.
+func readUpcall(ctx context.Context, upcallCh chan upcallEvent, timeout time.Duration, op string) (upcallEvent, error) {
+	var timeoutCh <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutCh = timer.C
+	}
+	select {
+	case event, ok := <-upcallCh:
+		if !ok {
+			return event, fmt.Errorf("%w while waiting for %s", errConnectionClosed, op)
+		}
+		return event, nil
+	case <-timeoutCh:
+		return upcallEvent{}, &TimeoutError{Op: op, Duration: timeout}
+	case <-ctx.Done():
+		return upcallEvent{}, ctx.Err()
+	}
+}
+
 func (disp *serviceDispatcher) findOrCreateCommand(
 	msgID dimse.MessageID,
 	cm *contextManager,
-	context contextManagerEntry) (*serviceCommandState, bool) {
+	entry contextManagerEntry) (*serviceCommandState, bool) {
 	disp.mu.Lock()
 	defer disp.mu.Unlock()
 	if cs, ok := disp.activeCommands[msgID]; ok {
@@ -77,9 +116,10 @@ func (disp *serviceDispatcher) findOrCreateCommand(
 		disp:      disp,
 		messageID: msgID,
 		cm:        cm,
-		context:   context,
+		context:   entry,
 		upcallCh:  make(chan upcallEvent, 128),
 	}
+	cs.ctx, cs.cancel = context.WithCancel(disp.ctx)
 	disp.activeCommands[msgID] = cs
 	dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Start command %+v", disp.label, cs)
 	return cs, false
@@ -115,10 +155,12 @@ func (disp *serviceDispatcher) newCommand(
 func (disp *serviceDispatcher) deleteCommand(cs *serviceCommandState) {
 	disp.mu.Lock()
 	dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Finish provider command %v", disp.label, cs.messageID)
-	if _, ok := disp.activeCommands[cs.messageID]; !ok {
+	// A closed command may have been dropped by dropClosedCommands already.
+	if active, ok := disp.activeCommands[cs.messageID]; ok && active == cs {
+		delete(disp.activeCommands, cs.messageID)
+	} else if !cs.closed {
 		panic(fmt.Sprintf("cs %+v", cs))
 	}
-	delete(disp.activeCommands, cs.messageID)
 	disp.mu.Unlock()
 	if cs.streamingReader != nil {
 		cs.streamingReader.Ack()
@@ -138,7 +180,7 @@ func (disp *serviceDispatcher) unregisterCallback(commandField uint16) {
 }
 
 func (disp *serviceDispatcher) handleEvent(event upcallEvent) {
-	if event.eventType == upcallEventHandshakeCompleted {
+	if event.eventType == upcallEventHandshakeCompleted || event.eventType == upcallEventError {
 		return
 	}
 	doassert(event.eventType == upcallEventData)
@@ -150,6 +192,10 @@ func (disp *serviceDispatcher) handleEvent(event upcallEvent) {
 		return
 	}
 	messageID := event.command.GetMessageID()
+	if _, ok := event.command.(*dimse.CCancelRq); ok {
+		disp.cancelCommand(messageID)
+		return
+	}
 	dc, found := disp.findOrCreateCommand(messageID, event.cm, context)
 	if found {
 		dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Forwarding command to existing command: %+v %+v", disp.label, event.command, dc)
@@ -160,28 +206,80 @@ func (disp *serviceDispatcher) handleEvent(event upcallEvent) {
 	disp.mu.Lock()
 	cb := disp.callbacks[event.command.CommandField()]
 	disp.mu.Unlock()
+	if cb == nil {
+		disp.deleteCommand(dc)
+		if event.data != nil {
+			_ = event.data.Ack()
+		}
+		if event.command.CommandField()&0x8000 != 0 {
+			// A response to a command that has finished, e.g., after
+			// a timeout.
+			dicomlog.Vprintf(0, "dicom.serviceDispatcher(%s): Dropping response to an unknown command: %v", disp.label, event.command)
+			return
+		}
+		dicomlog.Vprintf(0, "dicom.serviceDispatcher(%s): Unsupported request %v; aborting", disp.label, event.command)
+		disp.downcallCh <- stateEvent{event: evt15, err: fmt.Errorf("unsupported DIMSE request %v", event.command)}
+		return
+	}
 	go func() {
 		// Attach streaming reader to command state for handlers needing io.Reader
 		dc.streamingReader = event.data
 		cb(event.command, event.data, dc)
+		dc.cancel()
 		disp.deleteCommand(dc)
 	}()
 }
 
-// Must be called exactly once to shut down the dispatcher.
+// Cancel the context of the command with the given ID, in response to
+// C-CANCEL-RQ. The command may have finished already, in which case the
+// request is ignored. P3.7 9.3.2.3
+func (disp *serviceDispatcher) cancelCommand(messageID dimse.MessageID) {
+	disp.mu.Lock()
+	cs, ok := disp.activeCommands[messageID]
+	disp.mu.Unlock()
+	if !ok || cs.cancel == nil {
+		dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): C-CANCEL for unknown command %v", disp.label, messageID)
+		return
+	}
+	dicomlog.Vprintf(0, "dicom.serviceDispatcher(%s): Cancelling command %v", disp.label, messageID)
+	cs.cancel()
+}
+
+// Shut down the commands of the association that has ended. Commands already
+// shut down by an earlier call are left alone.
 func (disp *serviceDispatcher) close() {
 	disp.mu.Lock()
 	for _, cs := range disp.activeCommands {
+		if cs.closed {
+			continue
+		}
+		cs.closed = true
 		close(cs.upcallCh)
+		if cs.cancel != nil {
+			cs.cancel()
+		}
 	}
 	disp.mu.Unlock()
 	// TODO(saito): prevent new command from launching.
 }
 
+// Forget the commands shut down by close, so that a new association on this
+// dispatcher starts without them. Their owners may still call deleteCommand.
+func (disp *serviceDispatcher) dropClosedCommands() {
+	disp.mu.Lock()
+	for msgID, cs := range disp.activeCommands {
+		if cs.closed {
+			delete(disp.activeCommands, msgID)
+		}
+	}
+	disp.mu.Unlock()
+}
+
 func newServiceDispatcher(label string) *serviceDispatcher {
 	return &serviceDispatcher{
 		label:          label,
 		downcallCh:     make(chan stateEvent, 128),
+		ctx:            context.Background(),
 		activeCommands: make(map[dimse.MessageID]*serviceCommandState),
 		callbacks:      make(map[uint16]serviceCallback),
 		lastMessageID:  123,
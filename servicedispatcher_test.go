@@ -4,6 +4,7 @@ import (
 	"os"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/algm/go-netdicom/dimse"
 )
@@ -20,7 +21,7 @@ func TestServiceDispatcher_HandleEvent(t *testing.T) {
 		transferSyntaxUID: "1.2.840.10008.1.2",
 	}
 	cm.contextIDToAbstractSyntaxNameMap[1] = entry
-	cm.abstractSyntaxNameToContextIDMap[entry.abstractSyntaxUID] = entry
+	cm.abstractSyntaxNameToContextIDMap[entry.abstractSyntaxUID] = []*contextManagerEntry{entry}
 
 	// Build a simple command (CEchoRq has no data)
 	cmd := &dimse.CEchoRq{
@@ -79,7 +80,7 @@ func TestServiceDispatcher_NewCommandAndFind(t *testing.T) {
 	cm := newContextManager("cm2")
 	entry := contextManagerEntry{contextID: 3, abstractSyntaxUID: "1", transferSyntaxUID: "ts"}
 	cm.contextIDToAbstractSyntaxNameMap[3] = &entry
-	cm.abstractSyntaxNameToContextIDMap["1"] = &entry
+	cm.abstractSyntaxNameToContextIDMap["1"] = []*contextManagerEntry{&entry}
 
 	cs1, err := disp.newCommand(cm, entry)
 	if err != nil {
@@ -97,3 +98,80 @@ func TestServiceDispatcher_NewCommandAndFind(t *testing.T) {
 		t.Error("expected same commandState returned")
 	}
 }
+
+// A C-CANCEL-RQ that arrives while the command finishes, or after it has
+// finished, is ignored.
+func TestServiceDispatcher_CancelAfterFinish(t *testing.T) {
+	disp := newServiceDispatcher("test-cancel")
+	cm := newContextManager("cm-cancel")
+	entry := &contextManagerEntry{contextID: 1, abstractSyntaxUID: "1.2.3", transferSyntaxUID: "1.2.840.10008.1.2"}
+	cm.contextIDToAbstractSyntaxNameMap[1] = entry
+	cm.abstractSyntaxNameToContextIDMap[entry.abstractSyntaxUID] = []*contextManagerEntry{entry}
+
+	var wg sync.WaitGroup
+	disp.registerCallback(dimse.CommandFieldCEchoRq, func(msg dimse.Message, data *dimse.DimseCommand, cs *serviceCommandState) {
+		wg.Done()
+	})
+	event := func(cmd dimse.Message) upcallEvent {
+		return upcallEvent{eventType: upcallEventData, cm: cm, contextID: 1, command: cmd}
+	}
+	for i := 0; i < 100; i++ {
+		id := dimse.MessageID(i)
+		wg.Add(1)
+		disp.handleEvent(event(&dimse.CEchoRq{MessageID: id, CommandDataSetType: dimse.CommandDataSetTypeNull}))
+		// Races with the handler returning.
+		disp.handleEvent(event(&dimse.CCancelRq{MessageIDBeingRespondedTo: id, CommandDataSetType: dimse.CommandDataSetTypeNull}))
+		wg.Wait()
+	}
+	waitNoActiveCommands := func() {
+		for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+			disp.mu.Lock()
+			n := len(disp.activeCommands)
+			disp.mu.Unlock()
+			if n == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%d commands still active", n)
+			}
+		}
+	}
+	waitNoActiveCommands()
+
+	// After the command has finished, and for an ID never used.
+	for _, id := range []dimse.MessageID{0, 99, 1000} {
+		disp.handleEvent(event(&dimse.CCancelRq{MessageIDBeingRespondedTo: id, CommandDataSetType: dimse.CommandDataSetTypeNull}))
+	}
+	// The ID can be used again.
+	wg.Add(1)
+	disp.handleEvent(event(&dimse.CEchoRq{MessageID: 0, CommandDataSetType: dimse.CommandDataSetTypeNull}))
+	wg.Wait()
+	waitNoActiveCommands()
+}
+
+// Both Release and the statemachine's shutdown close the dispatcher.
+func TestServiceDispatcher_CloseTwice(t *testing.T) {
+	disp := newServiceDispatcher("test-close")
+	cm := newContextManager("cm-close")
+	entry := contextManagerEntry{contextID: 1, abstractSyntaxUID: "1", transferSyntaxUID: "ts"}
+	cs, err := disp.newCommand(cm, entry)
+	if err != nil {
+		t.Fatalf("newCommand failed: %v", err)
+	}
+	disp.close()
+	disp.close()
+	if _, ok := <-cs.upcallCh; ok {
+		t.Error("expected upcallCh to be closed")
+	}
+
+	// A command of the next association, e.g., after a reconnect, is shut
+	// down when that association ends.
+	cs2, err := disp.newCommand(cm, entry)
+	if err != nil {
+		t.Fatalf("newCommand failed: %v", err)
+	}
+	disp.close()
+	if _, ok := <-cs2.upcallCh; ok {
+		t.Error("expected upcallCh of the second command to be closed")
+	}
+}
@@ -7,14 +7,20 @@ import (
 	"crypto/tls"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"time"
 
 	"github.com/algm/go-netdicom/commandset"
 	"github.com/algm/go-netdicom/dimse"
+	"github.com/algm/go-netdicom/pdu"
+	"github.com/algm/go-netdicom/pdu/pdu_item"
 	"github.com/algm/go-netdicom/sopclass"
 	dicom "github.com/grailbio/go-dicom"
 	"github.com/grailbio/go-dicom/dicomio"
 	"github.com/grailbio/go-dicom/dicomlog"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
 )
 
 // CMoveResult is an object streamed by CMove implementation.
@@ -26,14 +32,17 @@ type CMoveResult struct {
 }
 
 func handleCStore(
-	ctx context.Context,
 	params ServiceProviderParams,
 	connState ConnectionState,
 	c *dimse.CStoreRq, data *dimse.DimseCommand,
 	cs *serviceCommandState) {
 	status := dimse.Status{Status: dimse.StatusUnrecognizedOperation}
 
-	if params.CStore != nil {
+	if data != nil && data.Err() != nil {
+		// E.g., the data set would have exceeded the spool quota.
+		dicomlog.Vprintf(0, "dicom.serviceProvider: C-STORE data set of %s dropped: %v", c.AffectedSOPInstanceUID, data.Err())
+		status = dimse.Status{Status: dimse.CStoreOutOfResources, ErrorComment: data.Err().Error()}
+	} else if params.CStore != nil {
 		// Determine data reader and size directly from DimseCommand
 		var (
 			dataReader io.Reader
@@ -44,16 +53,28 @@ func handleCStore(
 			dataReader = data
 			dataSize = data.Size()
 		}
+		dataReader, transferSyntaxUID := inflateReader(dataReader, cs.context.transferSyntaxUID)
+		if transferSyntaxUID != cs.context.transferSyntaxUID {
+			// The inflated size is not known in advance.
+			dataSize = -1
+		}
 
 		status = params.CStore(
-			ctx,
+			cs.ctx,
 			connState,
-			cs.context.transferSyntaxUID,
+			transferSyntaxUID,
 			c.AffectedSOPClassUID,
 			c.AffectedSOPInstanceUID,
 			dataReader,
 			dataSize)
 	}
+	if data != nil {
+		if data.Size() < 0 {
+			// Streamed; wait for the rest of the data set.
+			_, _ = io.Copy(io.Discard, data)
+		}
+		_ = data.Ack()
+	}
 
 	resp := &dimse.CStoreRsp{
 		AffectedSOPClassUID:       c.AffectedSOPClassUID,
@@ -63,11 +84,6 @@ func handleCStore(
 		Status:                    status,
 	}
 	cs.sendMessage(resp, nil)
-
-	// Clean up temporary file associated with DimseCommand
-	if data != nil {
-		_ = data.Ack()
-	}
 }
 
 func handleCFind(
@@ -103,9 +119,12 @@ func handleCFind(
 	status := dimse.Status{Status: dimse.StatusSuccess}
 	responseCh := make(chan CFindResult, 128)
 	go func() {
-		params.CFind(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, elems, responseCh)
+		params.CFind(cs.ctx, connState, inflatedTransferSyntax(cs.context.transferSyntaxUID), c.AffectedSOPClassUID, elems, responseCh)
 	}()
 	for resp := range responseCh {
+		if cs.ctx.Err() != nil {
+			break
+		}
 		if resp.Err != nil {
 			status = dimse.Status{
 				Status:       dimse.CFindUnableToProcess,
@@ -130,6 +149,10 @@ func handleCFind(
 			Status:                    dimse.Status{Status: dimse.StatusPending},
 		}, payload)
 	}
+	if cs.ctx.Err() != nil {
+		// The client sent C-CANCEL-RQ. P3.4 C.4.1.3.1
+		status = dimse.Status{Status: dimse.StatusCancel}
+	}
 	cs.sendMessage(&dimse.CFindRsp{
 		AffectedSOPClassUID:       c.AffectedSOPClassUID,
 		MessageIDBeingRespondedTo: c.MessageID,
@@ -183,12 +206,15 @@ func handleCMove(
 	dicomlog.Vprintf(1, "dicom.serviceProvider: C-MOVE-RQ payload: %s", elementsString(elems))
 	responseCh := make(chan CMoveResult, 128)
 	go func() {
-		params.CMove(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, elems, responseCh)
+		params.CMove(cs.ctx, connState, inflatedTransferSyntax(cs.context.transferSyntaxUID), c.AffectedSOPClassUID, elems, responseCh)
 	}()
-	// responseCh :=
 	status := dimse.Status{Status: dimse.StatusSuccess}
-	var numSuccesses, numFailures uint16
+	var numSuccesses, numFailures, numRemaining uint16
+	var failedSOPInstanceUIDs []string
 	for resp := range responseCh {
+		if cs.ctx.Err() != nil {
+			break
+		}
 		if resp.Err != nil {
 			status = dimse.Status{
 				Status:       dimse.CFindUnableToProcess,
@@ -197,13 +223,18 @@ func handleCMove(
 			break
 		}
 		dicomlog.Vprintf(0, "dicom.serviceProvider: C-MOVE: Sending %v to %v(%s)", resp.Path, c.MoveDestination, remoteHostPort)
-		err := runCStoreOnNewAssociation(params.AETitle, c.MoveDestination, remoteHostPort, resp.DataSet)
+		err := runCStoreOnNewAssociation(cs.ctx, params.AETitle, c.MoveDestination, remoteHostPort,
+			params.RemoteAETLSConfigs[c.MoveDestination], params.CMoveRetryPolicy, resp.DataSet)
 		if err != nil {
 			dicomlog.Vprintf(0, "dicom.serviceProvider: C-MOVE: C-store of %v to %v(%v) failed: %v", resp.Path, c.MoveDestination, remoteHostPort, err)
 			numFailures++
+			if uid, err := getSOPInstanceUID(resp.DataSet); err == nil {
+				failedSOPInstanceUIDs = append(failedSOPInstanceUIDs, uid)
+			}
 		} else {
 			numSuccesses++
 		}
+		numRemaining = uint16(resp.Remaining)
 		cs.sendMessage(&dimse.CMoveRsp{
 			AffectedSOPClassUID:            c.AffectedSOPClassUID,
 			MessageIDBeingRespondedTo:      c.MessageID,
@@ -214,13 +245,35 @@ func handleCMove(
 			Status:                         dimse.Status{Status: dimse.StatusPending},
 		}, nil)
 	}
+	// P3.4 C.4.2.1.4: the final response lists the instances that could not
+	// be moved.
+	dataSetType := dimse.CommandDataSetTypeNull
+	var failedPayload []byte
+	if cs.ctx.Err() != nil {
+		// The client sent C-CANCEL-RQ. P3.4 C.4.2.1.4
+		status = dimse.Status{Status: dimse.StatusCancel}
+	} else {
+		numRemaining = 0
+	}
+	if numFailures > 0 && status.Status == dimse.StatusSuccess {
+		status = dimse.Status{Status: dimse.CMoveSubOperationsCompleteWithFailures}
+		if len(failedSOPInstanceUIDs) > 0 {
+			failedPayload, err = encodeFailedSOPInstanceUIDList(failedSOPInstanceUIDs, cs.context.transferSyntaxUID)
+			if err != nil {
+				dicomlog.Vprintf(0, "dicom.serviceProvider: C-MOVE: failed to encode failed SOP instance UIDs: %v", err)
+			} else {
+				dataSetType = dimse.CommandDataSetTypeNonNull
+			}
+		}
+	}
 	cs.sendMessage(&dimse.CMoveRsp{
 		AffectedSOPClassUID:            c.AffectedSOPClassUID,
 		MessageIDBeingRespondedTo:      c.MessageID,
-		CommandDataSetType:             dimse.CommandDataSetTypeNull,
+		CommandDataSetType:             dataSetType,
+		NumberOfRemainingSuboperations: numRemaining,
 		NumberOfCompletedSuboperations: numSuccesses,
 		NumberOfFailedSuboperations:    numFailures,
-		Status:                         status}, nil)
+		Status:                         status}, failedPayload)
 	// Drain the responses in case of errors
 	for range responseCh {
 	}
@@ -263,11 +316,14 @@ func handleCGet(
 	dicomlog.Vprintf(1, "dicom.serviceProvider: C-GET-RQ payload: %s", elementsString(elems))
 	responseCh := make(chan CMoveResult, 128)
 	go func() {
-		params.CGet(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, elems, responseCh)
+		params.CGet(cs.ctx, connState, inflatedTransferSyntax(cs.context.transferSyntaxUID), c.AffectedSOPClassUID, elems, responseCh)
 	}()
 	status := dimse.Status{Status: dimse.StatusSuccess}
-	var numSuccesses, numFailures uint16
+	var numSuccesses, numFailures, numRemaining uint16
 	for resp := range responseCh {
+		if cs.ctx.Err() != nil {
+			break
+		}
 		if resp.Err != nil {
 			status = dimse.Status{
 				Status:       dimse.CFindUnableToProcess,
@@ -283,7 +339,9 @@ func handleCGet(
 			}
 			break
 		}
-		err = runCStoreOnAssociation(subCs.upcallCh, subCs.disp.downcallCh, subCs.cm, subCs.messageID, resp.DataSet)
+		if err = checkCGetSubOpRole(cs.cm, resp.DataSet); err == nil {
+			err = runCStoreOnAssociation(context.Background(), subCs.upcallCh, subCs.disp.downcallCh, subCs.cm, subCs.messageID, resp.DataSet, 0)
+		}
 		if err != nil {
 			dicomlog.Vprintf(0, "dicom.serviceProvider: C-GET: C-store of %v failed: %v", resp.Path, err)
 			numFailures++
@@ -291,6 +349,7 @@ func handleCGet(
 			dicomlog.Vprintf(0, "dicom.serviceProvider: C-GET: Sent %v", resp.Path)
 			numSuccesses++
 		}
+		numRemaining = uint16(resp.Remaining)
 		cs.sendMessage(&dimse.CGetRsp{
 			AffectedSOPClassUID:            c.AffectedSOPClassUID,
 			MessageIDBeingRespondedTo:      c.MessageID,
@@ -302,10 +361,17 @@ func handleCGet(
 		}, nil)
 		cs.disp.deleteCommand(subCs)
 	}
+	if cs.ctx.Err() != nil {
+		// The client sent C-CANCEL-RQ. P3.4 C.4.3.1.4
+		status = dimse.Status{Status: dimse.StatusCancel}
+	} else {
+		numRemaining = 0
+	}
 	cs.sendMessage(&dimse.CGetRsp{
 		AffectedSOPClassUID:            c.AffectedSOPClassUID,
 		MessageIDBeingRespondedTo:      c.MessageID,
 		CommandDataSetType:             dimse.CommandDataSetTypeNull,
+		NumberOfRemainingSuboperations: numRemaining,
 		NumberOfCompletedSuboperations: numSuccesses,
 		NumberOfFailedSuboperations:    numFailures,
 		Status:                         status}, nil)
@@ -318,6 +384,24 @@ func handleCGet(
 	}
 }
 
+// C-STORE sub-operations of C-GET run on the C-GET association with the
+// requestor acting as the storage SCP, so the requestor must have been granted
+// the SCP role for the SOP class of the dataset.
+func checkCGetSubOpRole(cm *contextManager, ds *dicom.DataSet) error {
+	elem, err := ds.FindElementByTag(dicomtag.MediaStorageSOPClassUID)
+	if err != nil {
+		return err
+	}
+	sopClassUID, err := elem.GetString()
+	if err != nil {
+		return err
+	}
+	if !cm.isRequestorSCP(sopClassUID) {
+		return fmt.Errorf("dicom.serviceProvider: SCP role for %v not granted to the requestor", dicomuid.UIDString(sopClassUID))
+	}
+	return nil
+}
+
 func handleCEcho(
 	params ServiceProviderParams,
 	connState ConnectionState,
@@ -325,7 +409,7 @@ func handleCEcho(
 	cs *serviceCommandState) {
 	status := dimse.Status{Status: dimse.StatusUnrecognizedOperation}
 	if params.CEcho != nil {
-		status = params.CEcho(connState)
+		status = params.CEcho(cs.ctx, connState)
 	}
 	dicomlog.Vprintf(0, "dicom.serviceProvider: Received E-ECHO: context: %+v, status: %+v", cs.context, status)
 	resp := &dimse.CEchoRsp{
@@ -349,6 +433,82 @@ type ServiceProviderParams struct {
 	// map should be nonempty iff the server supports CMove.
 	RemoteAEs map[string]string
 
+	// TLS client settings for the remote AEs listed in RemoteAEs, keyed by
+	// AE title. C-MOVE sub-operations to an AE listed here run over TLS.
+	// Other AEs are reached in plaintext.
+	RemoteAETLSConfigs map[string]*tls.Config
+
+	// CMoveRetryPolicy, if set, retries the C-STORE sub-operations of C-MOVE
+	// that fail, e.g., because the destination is temporarily out of
+	// resources or unreachable. Without it, a failed sub-operation is
+	// counted as a failure right away.
+	CMoveRetryPolicy *RetryPolicy
+
+	// SupportedSOPClasses lists the abstract syntaxes the server is willing
+	// to accept. A presentation context that proposes any other abstract
+	// syntax is rejected with "abstract-syntax-not-supported". If empty, every
+	// proposed abstract syntax is accepted.
+	SupportedSOPClasses []string
+
+	// SupportedTransferSyntaxes lists the transfer syntaxes the server is
+	// willing to accept. A presentation context none of whose proposed
+	// transfer syntaxes appear in the list is rejected with
+	// "transfer-syntaxes-not-supported". If empty, the first transfer syntax
+	// proposed by the client is accepted.
+	SupportedTransferSyntaxes []string
+
+	// PreferredTransferSyntaxes ranks transfer syntaxes from the most to the
+	// least preferred. When the client proposes several acceptable transfer
+	// syntaxes in one presentation context, the server picks the one that
+	// appears earliest in this list, regardless of the client's ordering.
+	// Proposals not in the list rank after all the listed ones, in the
+	// client's order. If empty, the client's ordering is used. E.g., list
+	// dicomuid.DeflatedExplicitVRLittleEndian first to have data sets
+	// compressed whenever the client proposes it.
+	PreferredTransferSyntaxes []string
+
+	// MaxOpsPerformed is the number of DIMSE operations the server is willing
+	// to perform concurrently on one association, when the client proposes an
+	// asynchronous operations window (P3.7 D.3.3.3). Zero or one disables
+	// asynchronous operations.
+	MaxOpsPerformed int
+
+	// MaxPDUSize is the maximum PDU size, in bytes, the server advertises to
+	// clients, and the largest PDU it accepts. Zero means DefaultMaxPDUSize.
+	// UnlimitedPDUSize advertises no limit.
+	MaxPDUSize int
+
+	// MaxSendPDUSize, if positive, caps the size of the PDUs sent to clients
+	// below what the clients advertise.
+	MaxSendPDUSize int
+
+	// ARTIMTimeout is how long the server waits for A-ASSOCIATE-RQ after
+	// accepting a connection, and for the connection to close after a
+	// release or an abort (P3.8 9.1.5). Zero means 10 seconds.
+	ARTIMTimeout time.Duration
+
+	// IdleTimeout, if positive, aborts an association on which no PDU has
+	// been sent or received for this long.
+	IdleTimeout time.Duration
+
+	// OnExtendedNegotiation, if non-nil, answers SOP class extended
+	// negotiation proposals (P3.7 D.3.3.5) for accepted SOP classes. If nil,
+	// the proposals are left unanswered, which tells the client that none of
+	// the proposed features is supported. SOP class common extended
+	// negotiation items have no answer; they are available through
+	// AssociationRequest.UserInformation.
+	OnExtendedNegotiation ExtendedNegotiationCallback
+
+	// OnAssociationRequest, if non-nil, is called on every A-ASSOCIATE-RQ
+	// before presentation contexts are negotiated. It can be used to enforce,
+	// e.g., AE-title allowlists. If nil, every association is accepted.
+	OnAssociationRequest AssociationRequestCallback
+
+	// AuthenticateUser, if non-nil, is called on every A-ASSOCIATE-RQ that
+	// passed OnAssociationRequest, to check the user identity presented by
+	// the client. If nil, the user identity, if any, is ignored.
+	AuthenticateUser UserIdentityCallback
+
 	// Called on C_ECHO request. If nil, a C-ECHO call will produce an error response.
 	//
 	// TODO(saito) Support a default C-ECHO callback?
@@ -371,11 +531,34 @@ type ServiceProviderParams struct {
 	// The callback always receives data as io.Reader for memory efficiency.
 	CStore CStoreCallback
 
-	// StreamingThreshold specifies the size (in bytes) above which true streaming mode
-	// is enabled. Files smaller than this threshold will be buffered in memory for
-	// better performance. Files larger will stream directly from network. Default: 100MB.
+	// StreamingThreshold is the C-STORE data set size, in bytes, above which
+	// the data is streamed to CStore as it arrives from the network, rather
+	// than received in full before CStore is called. Smaller data sets are
+	// kept in memory up to dimse.DefaultMemoryThreshold, and spooled to a
+	// temporary file beyond that. Zero means DefaultStreamingThreshold. A
+	// negative value disables streaming.
 	StreamingThreshold int64
 
+	// SpoolDir is the directory of the temporary files that C-STORE data
+	// sets too large to keep in memory are spooled to. It should be
+	// dedicated to this server: NewServiceProvider removes the spool files
+	// left in it, e.g., by a previous process that crashed. Empty means
+	// os.TempDir(), which is not cleaned up that way. Spool files are
+	// removed once the data set has been handled, and at the latest when
+	// the association ends.
+	SpoolDir string
+
+	// SpoolQuota, if positive, caps the disk space, in bytes, taken by the
+	// spool files of all associations. A C-STORE whose data set would
+	// exceed it is answered with "refused: out of resources" (A700) without
+	// calling CStore. Data sets that are streamed count only up to
+	// StreamingThreshold.
+	SpoolQuota int64
+
+	// AssociationSpoolQuota, if positive, caps the disk space taken by the
+	// spool files of one association, in the same way as SpoolQuota.
+	AssociationSpoolQuota int64
+
 	// TLSConfig, if non-nil, enables TLS on the connection. See
 	// https://gist.github.com/michaljemala/d6f4e01c4834bf47a9c4 for an
 	// example for creating a TLS config from x509 cert files.
@@ -384,9 +567,45 @@ type ServiceProviderParams struct {
 	Verbose bool
 }
 
+// DefaultStreamingThreshold is the default value of
+// ServiceProviderParams.StreamingThreshold.
+const DefaultStreamingThreshold = 100 << 20
+
 // DefaultMaxPDUSize is the the PDU size advertized by go-netdicom.
 const DefaultMaxPDUSize = 4 << 20
 
+// UnlimitedPDUSize, when set in MaxPDUSize, advertises that PDUs of any size
+// are accepted.
+const UnlimitedPDUSize = -1
+
+// minPDUSize is the smallest PDU size accepted in MaxPDUSize and
+// MaxSendPDUSize.
+const minPDUSize = 1024
+
+func validateMaxPDUSize(maxPDUSize, maxSendPDUSize int) error {
+	if maxPDUSize != 0 && maxPDUSize != UnlimitedPDUSize &&
+		(maxPDUSize < minPDUSize || int64(maxPDUSize) > math.MaxUint32) {
+		return fmt.Errorf("MaxPDUSize out of range: %d", maxPDUSize)
+	}
+	if maxSendPDUSize != 0 && (maxSendPDUSize < minPDUSize || int64(maxSendPDUSize) > math.MaxUint32) {
+		return fmt.Errorf("MaxSendPDUSize out of range: %d", maxSendPDUSize)
+	}
+	return nil
+}
+
+// advertisedPDUSize returns the value of UserInformationMaximumLengthItem for
+// the given MaxPDUSize setting.
+func advertisedPDUSize(maxPDUSize int) uint32 {
+	switch maxPDUSize {
+	case 0:
+		return DefaultMaxPDUSize
+	case UnlimitedPDUSize:
+		return 0
+	default:
+		return uint32(maxPDUSize)
+	}
+}
+
 // CStoreCallback is called C-STORE request.  sopInstanceUID is the UID of the
 // data.  sopClassUID is the data type requested
 // (e.g.,"1.2.840.10008.5.1.4.1.1.1.2"), and transferSyntaxUID is the encoding
@@ -404,8 +623,20 @@ const DefaultMaxPDUSize = 4 << 20
 // header, followed by data. It should return either dimse.Success0 on success,
 // or one of CStoreStatus* error codes on errors.
 // CStoreCallback is called on C-STORE request. All data is provided as a stream
-// via io.Reader for memory efficiency. For small files, the reader will be backed
-// by a bytes.Reader. For large files, it streams directly from network PDUs.
+// via io.Reader for memory efficiency. Data sets up to
+// ServiceProviderParams.StreamingThreshold are received in full before the
+// callback is called. Larger ones are streamed as the PDUs arrive: the callback
+// is called once StreamingThreshold bytes have been received, "dataSize" is -1,
+// and reads block until more data arrives. A read fails if the association
+// ends before the data set has been received in full. Data left unread when the
+// callback returns is received and discarded before the response is sent.
+//
+// Data received in DeflatedExplicitVRLittleEndian is inflated as it is read,
+// and "transferSyntaxUID" is ExplicitVRLittleEndian. "dataSize" is then -1,
+// since the inflated size is not known in advance.
+//
+// ctx is cancelled when the association ends, e.g., when the client aborts it
+// in the middle of a transfer.
 type CStoreCallback func(
 	ctx context.Context,
 	conn ConnectionState,
@@ -418,7 +649,9 @@ type CStoreCallback func(
 // CFindCallback implements a C-FIND handler.  sopClassUID is the data type
 // requested (e.g.,"1.2.840.10008.5.1.4.1.1.1.2"), and transferSyntaxUID is the
 // data encoding requested (e.g., "1.2.840.10008.1.2.1").  These args are
-// extracted from the request packet.
+// extracted from the request packet. Filters received in
+// DeflatedExplicitVRLittleEndian are inflated, and transferSyntaxUID is then
+// ExplicitVRLittleEndian.
 //
 // This function should stream CFindResult objects through "ch". The function
 // may block.  To report a matched DICOM dataset, the function should send one
@@ -426,7 +659,12 @@ type CStoreCallback func(
 // matches, the callback should send multiple CFindResult objects, one for each
 // dataset.  The callback must close the channel after it produces all the
 // responses.
+//
+// ctx is cancelled when the client cancels the request with C-CANCEL-RQ, or
+// when the association ends. The callback should then stop producing results
+// and close the channel.
 type CFindCallback func(
+	ctx context.Context,
 	conn ConnectionState,
 	transferSyntaxUID string,
 	sopClassUID string,
@@ -436,12 +674,18 @@ type CFindCallback func(
 // CMoveCallback implements C-MOVE or C-GET handler.  sopClassUID is the data
 // type requested (e.g.,"1.2.840.10008.5.1.4.1.1.1.2"), and transferSyntaxUID is
 // the data encoding requested (e.g., "1.2.840.10008.1.2.1").  These args are
-// extracted from the request packet.
+// extracted from the request packet. As for CFindCallback, transferSyntaxUID
+// is ExplicitVRLittleEndian for filters received deflated.
 //
 // The callback must stream datasets or error to "ch". The callback may
 // block. The callback must close the channel after it produces all the
 // datasets.
+//
+// ctx is cancelled when the client cancels the request with C-CANCEL-RQ, or
+// when the association ends. The callback should then stop producing datasets
+// and close the channel.
 type CMoveCallback func(
+	ctx context.Context,
 	conn ConnectionState,
 	transferSyntaxUID string,
 	sopClassUID string,
@@ -453,11 +697,91 @@ type ConnectionState struct {
 	// TLS connection state. It is nonempty only when the connection is set up
 	// over TLS.
 	TLS tls.ConnectionState
+
+	// AE titles sent by the client in A-ASSOCIATE-RQ, stripped of their
+	// space padding.
+	CallingAETitle string
+	CalledAETitle  string
+
+	RemoteAddr net.Addr
+	LocalAddr  net.Addr
+
+	// Identify the client's DICOM implementation, as sent in
+	// A-ASSOCIATE-RQ. Empty if the client didn't send them.
+	PeerImplementationClassUID    string
+	PeerImplementationVersionName string
+
+	// MaxPDUSize is the maximum PDU size advertised by the client. Zero means
+	// unlimited.
+	MaxPDUSize int
+
+	// PresentationContexts lists the presentation contexts accepted for the
+	// association, ordered by ID.
+	PresentationContexts []PresentationContext
+
+	// AssociationID identifies the association in logs. It is unique within
+	// the process.
+	AssociationID string
+}
+
+// PresentationContext is a presentation context accepted during the
+// association handshake.
+type PresentationContext struct {
+	ID                byte
+	AbstractSyntaxUID string
+	TransferSyntaxUID string
 }
 
 // CEchoCallback implements C-ECHO callback. It typically just returns
 // dimse.Success.
-type CEchoCallback func(conn ConnectionState) dimse.Status
+//
+// ctx is cancelled when the association ends.
+type CEchoCallback func(ctx context.Context, conn ConnectionState) dimse.Status
+
+// AssociationRequest describes an A-ASSOCIATE-RQ received by the server. AE
+// titles are stripped of their space padding.
+type AssociationRequest struct {
+	CallingAETitle string // AE title of the client
+	CalledAETitle  string // AE title the client wants to talk to
+	RemoteAddr     net.Addr
+
+	// Presentation contexts proposed by the client.
+	PresentationContexts []*pdu_item.PresentationContextItem
+
+	// Sub-items of the user-information item, e.g., the maximum PDU length
+	// and the implementation class UID.
+	UserInformation []pdu_item.SubItem
+}
+
+// AssociationRequestCallback decides whether to accept an association. It
+// should return nil to accept the request. Otherwise, the request is rejected
+// with the returned A-ASSOCIATE-RJ, e.g.,
+//
+//	&pdu.AAssociateRj{
+//		Result: pdu.ResultRejectedPermanent,
+//		Source: pdu.SourceULServiceUser,
+//		Reason: pdu.RejectReasonCallingAETitleNotRecognized,
+//	}
+//
+// Zero Result and Source fields default to ResultRejectedPermanent and
+// SourceULServiceUser, respectively.
+type AssociationRequestCallback func(req AssociationRequest) *pdu.AAssociateRj
+
+// ExtendedNegotiationCallback answers a SOP class extended negotiation proposal.
+// info is the service-class application information proposed by the client for
+// sopClassUID, e.g., the C-FIND relational-query flags (P3.4 C.3.5). The
+// callback should return the application information accepted by the server,
+// typically info with the unsupported features cleared, or nil not to answer.
+type ExtendedNegotiationCallback func(sopClassUID string, info []byte) []byte
+
+// UserIdentityCallback authenticates the client of an association. identity
+// is the user identity (P3.7 D.3.3.7) proposed by the client, or nil if the
+// client presented none. The callback should return a non-nil error to reject
+// the association. Otherwise, if the client requested a positive response, the
+// server replies with serverResponse, e.g., a Kerberos server ticket or a SAML
+// response. serverResponse should be empty for the username-based identity
+// types.
+type UserIdentityCallback func(req AssociationRequest, identity *pdu_item.UserIdentitySubItem) (serverResponse []byte, err error)
 
 // ServiceProvider encapsulates the state for DICOM server (provider).
 type ServiceProvider struct {
@@ -465,6 +789,8 @@ type ServiceProvider struct {
 	listener net.Listener
 	// Label is a unique string used in log messages to identify this provider.
 	label string
+	// Enforces SpoolQuota across the associations.
+	spool *dimse.Spool
 }
 
 func writeElementsToBytes(elems []*dicom.Element, transferSyntaxUID string) ([]byte, error) {
@@ -475,10 +801,14 @@ func writeElementsToBytes(elems []*dicom.Element, transferSyntaxUID string) ([]b
 	if err := dataEncoder.Error(); err != nil {
 		return nil, err
 	}
-	return dataEncoder.Bytes(), nil
+	return deflateIfNeeded(dataEncoder.Bytes(), transferSyntaxUID)
 }
 
 func readElementsInBytes(data []byte, transferSyntaxUID string) ([]*dicom.Element, error) {
+	data, err := inflateIfNeeded(data, transferSyntaxUID)
+	if err != nil {
+		return nil, err
+	}
 	decoder := dicomio.NewBytesDecoderWithTransferSyntax(data, transferSyntaxUID)
 	var elems []*dicom.Element
 	for !decoder.EOF() {
@@ -506,18 +836,56 @@ func elementsString(elems []*dicom.Element) string {
 	return s + "]"
 }
 
+// Return the SOP instance UID of "ds", taken from the file meta information or,
+// failing that, from the dataset itself.
+func getSOPInstanceUID(ds *dicom.DataSet) (string, error) {
+	elem, err := ds.FindElementByTag(dicomtag.MediaStorageSOPInstanceUID)
+	if err != nil {
+		if elem, err = ds.FindElementByTag(dicomtag.SOPInstanceUID); err != nil {
+			return "", err
+		}
+	}
+	return elem.GetString()
+}
+
+// Encode the identifier of a C-MOVE or C-GET final response, which lists the
+// instances whose sub-operations failed.
+func encodeFailedSOPInstanceUIDList(uids []string, transferSyntaxUID string) ([]byte, error) {
+	values := make([]interface{}, len(uids))
+	for i, uid := range uids {
+		values[i] = uid
+	}
+	elem, err := dicom.NewElement(dicomtag.FailedSOPInstanceUIDList, values...)
+	if err != nil {
+		return nil, err
+	}
+	return writeElementsToBytes([]*dicom.Element{elem}, transferSyntaxUID)
+}
+
 // Send "ds" to remoteHostPort using C-STORE. Called as part of C-MOVE.
-func runCStoreOnNewAssociation(myAETitle, remoteAETitle, remoteHostPort string, ds *dicom.DataSet) error {
+func runCStoreOnNewAssociation(ctx context.Context, myAETitle, remoteAETitle, remoteHostPort string, tlsConfig *tls.Config,
+	retryPolicy *RetryPolicy, ds *dicom.DataSet) error {
+	// Data in a compressed transfer syntax can't be converted, so offer the
+	// data's own transfer syntax too.
+	transferSyntaxes := dicomio.StandardTransferSyntaxes
+	if elem, err := ds.FindElementByTag(dicomtag.TransferSyntaxUID); err == nil {
+		if uid, err := elem.GetString(); err == nil && !isNativeTransferSyntax(uid) {
+			transferSyntaxes = append([]string{uid}, transferSyntaxes...)
+		}
+	}
 	su, err := NewServiceUser(ServiceUserParams{
-		CalledAETitle:  remoteAETitle,
-		CallingAETitle: myAETitle,
-		SOPClasses:     sopclass.StorageClasses})
+		CalledAETitle:    remoteAETitle,
+		CallingAETitle:   myAETitle,
+		SOPClasses:       sopclass.StorageClasses,
+		TransferSyntaxes: transferSyntaxes,
+		TLSConfig:        tlsConfig,
+		RetryPolicy:      retryPolicy})
 	if err != nil {
 		return err
 	}
 	defer su.Release()
 	su.Connect(remoteHostPort)
-	err = su.CStore(ds)
+	err = su.CStoreContext(ctx, ds)
 	dicomlog.Vprintf(1, "dicom.serviceProvider: C-STORE subop done: %v", err)
 	return err
 }
@@ -532,10 +900,20 @@ func NewServiceProvider(params ServiceProviderParams, port string) (*ServiceProv
 	if params.Verbose {
 		dicomlog.SetLevel(0)
 	}
+	if err := validateMaxPDUSize(params.MaxPDUSize, params.MaxSendPDUSize); err != nil {
+		return nil, err
+	}
+
+	if params.SpoolDir != "" {
+		if err := dimse.RemoveSpoolFiles(params.SpoolDir); err != nil {
+			return nil, err
+		}
+	}
 
 	sp := &ServiceProvider{
 		params: params,
 		label:  newUID("sp"),
+		spool:  dimse.NewSpool(params.SpoolDir, params.SpoolQuota, nil),
 	}
 	var err error
 	if params.TLSConfig != nil {
@@ -549,46 +927,74 @@ func NewServiceProvider(params ServiceProviderParams, port string) (*ServiceProv
 	return sp, nil
 }
 
-func getConnState(conn net.Conn) (cs ConnectionState) {
+func getConnState(conn net.Conn, cm *contextManager) (cs ConnectionState) {
 	tlsConn, ok := conn.(*tls.Conn)
 	if ok {
 		cs.TLS = tlsConn.ConnectionState()
 	}
+	cs.CallingAETitle = cm.callingAETitle
+	cs.CalledAETitle = cm.calledAETitle
+	cs.RemoteAddr = conn.RemoteAddr()
+	cs.LocalAddr = conn.LocalAddr()
+	cs.PeerImplementationClassUID = cm.peerImplementationClassUID
+	cs.PeerImplementationVersionName = cm.peerImplementationVersionName
+	cs.MaxPDUSize = cm.peerMaxPDUSize
+	cs.PresentationContexts = cm.acceptedPresentationContexts()
+	cs.AssociationID = cm.label
 	return
 }
 
 // RunProviderForConn starts threads for running a DICOM server on "conn". This
 // function returns immediately; "conn" will be cleaned up in the background.
+// params.SpoolQuota applies to this connection alone.
 func RunProviderForConn(ctx context.Context, conn net.Conn, params ServiceProviderParams) {
+	runProviderForConn(ctx, conn, params, dimse.NewSpool(params.SpoolDir, params.SpoolQuota, nil))
+}
+
+// Run the server on "conn". The spool files of the association count against
+// the quota of "spool".
+func runProviderForConn(ctx context.Context, conn net.Conn, params ServiceProviderParams, spool *dimse.Spool) {
+	spool = dimse.NewSpool(params.SpoolDir, params.AssociationSpoolQuota, spool)
 	upcallCh := make(chan upcallEvent, 128)
 	label := newUID("sc")
 	disp := newServiceDispatcher(label)
+	disp.ctx = ctx
 	disp.registerCallback(dimse.CommandFieldCStoreRq,
 		func(msg dimse.Message, data *dimse.DimseCommand, cs *serviceCommandState) {
-			handleCStore(ctx, params, getConnState(conn), msg.(*dimse.CStoreRq), data, cs)
+			handleCStore(params, getConnState(conn, cs.cm), msg.(*dimse.CStoreRq), data, cs)
 		})
 	disp.registerCallback(dimse.CommandFieldCFindRq,
 		func(msg dimse.Message, data *dimse.DimseCommand, cs *serviceCommandState) {
-			handleCFind(params, getConnState(conn), msg.(*dimse.CFindRq), data, cs)
+			handleCFind(params, getConnState(conn, cs.cm), msg.(*dimse.CFindRq), data, cs)
 		})
 	disp.registerCallback(dimse.CommandFieldCMoveRq,
 		func(msg dimse.Message, data *dimse.DimseCommand, cs *serviceCommandState) {
-			handleCMove(params, getConnState(conn), msg.(*dimse.CMoveRq), data, cs)
+			handleCMove(params, getConnState(conn, cs.cm), msg.(*dimse.CMoveRq), data, cs)
 		})
 	disp.registerCallback(dimse.CommandFieldCGetRq,
 		func(msg dimse.Message, data *dimse.DimseCommand, cs *serviceCommandState) {
-			handleCGet(params, getConnState(conn), msg.(*dimse.CGetRq), data, cs)
+			handleCGet(params, getConnState(conn, cs.cm), msg.(*dimse.CGetRq), data, cs)
 		})
 	disp.registerCallback(dimse.CommandFieldCEchoRq,
 		func(msg dimse.Message, data *dimse.DimseCommand, cs *serviceCommandState) {
-			handleCEcho(params, getConnState(conn), msg.(*dimse.CEchoRq), data, cs)
+			handleCEcho(params, getConnState(conn, cs.cm), msg.(*dimse.CEchoRq), data, cs)
 		})
-	go runStateMachineForServiceProvider(conn, upcallCh, disp.downcallCh, label)
+	smDone := make(chan struct{})
+	go func() {
+		runStateMachineForServiceProvider(params, conn, upcallCh, disp.downcallCh, label, spool)
+		close(smDone)
+	}()
 	for event := range upcallCh {
 		disp.handleEvent(event)
 	}
 	dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Finished connection %p (remote: %+v)", label, conn, conn.RemoteAddr())
 	disp.close()
+	<-smDone
+	// Remove the spool files that have not been released, e.g., because the
+	// association was aborted in the middle of a transfer.
+	if err := spool.Close(); err != nil {
+		dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Failed to remove spool files: %v", label, err)
+	}
 }
 
 // Run listens to incoming connections, accepts them, and runs the DICOM
@@ -620,7 +1026,7 @@ func (sp *ServiceProvider) Run(ctx context.Context) {
 			return
 		case conn := <-connCh:
 			dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Accepted connection %p (remote: %+v)", sp.label, conn, conn.RemoteAddr())
-			go func() { RunProviderForConn(ctx, conn, sp.params) }()
+			go func() { runProviderForConn(ctx, conn, sp.params, sp.spool) }()
 		case err := <-errCh:
 			// Check if the error is due to listener being closed (during shutdown)
 			if ctx.Err() != nil {
@@ -0,0 +1,1042 @@
+package netdicom
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/algm/go-netdicom/dimse"
+	"github.com/algm/go-netdicom/pdu"
+	"github.com/algm/go-netdicom/pdu/pdu_item"
+	"github.com/algm/go-netdicom/sopclass"
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/stretchr/testify/require"
+)
+
+// Start a provider on a random local port. The provider is shut down when the
+// test finishes.
+func startTestProvider(t *testing.T, params ServiceProviderParams) *ServiceProvider {
+	if params.AETitle == "" {
+		params.AETitle = "TEST_SCP"
+	}
+	if params.CEcho == nil {
+		params.CEcho = func(ctx context.Context, conn ConnectionState) dimse.Status { return dimse.Success }
+	}
+	sp, err := NewServiceProvider(params, "localhost:0")
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	go sp.Run(ctx)
+	t.Cleanup(func() {
+		cancel()
+		_ = sp.Close()
+	})
+	return sp
+}
+
+func TestOnAssociationRequest(t *testing.T) {
+	var mu sync.Mutex
+	var requests []AssociationRequest
+	sp := startTestProvider(t, ServiceProviderParams{
+		OnAssociationRequest: func(req AssociationRequest) *pdu.AAssociateRj {
+			mu.Lock()
+			requests = append(requests, req)
+			mu.Unlock()
+			if req.CallingAETitle != "GOOD_SCU" {
+				return &pdu.AAssociateRj{Reason: pdu.RejectReasonCallingAETitleNotRecognized}
+			}
+			return nil
+		},
+	})
+
+	for _, test := range []struct {
+		callingAETitle string
+		ok             bool
+	}{{"GOOD_SCU", true}, {"BAD_SCU", false}} {
+		su, err := NewServiceUser(ServiceUserParams{
+			CalledAETitle:  "TEST_SCP",
+			CallingAETitle: test.callingAETitle,
+			SOPClasses:     sopclass.VerificationClasses,
+		})
+		require.NoError(t, err)
+		su.Connect(sp.ListenAddr().String())
+		err = su.CEcho()
+		if test.ok {
+			require.NoError(t, err)
+		} else {
+			var rejected *AssociationRejectedError
+			require.ErrorAs(t, err, &rejected)
+			require.Equal(t, pdu.ResultRejectedPermanent, rejected.Result)
+			require.Equal(t, pdu.SourceULServiceUser, rejected.Source)
+			require.Equal(t, pdu.RejectReasonCallingAETitleNotRecognized, rejected.Reason)
+			require.False(t, rejected.Transient())
+		}
+		su.Release()
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, requests, 2)
+	req := requests[0]
+	require.Equal(t, "GOOD_SCU", req.CallingAETitle)
+	require.Equal(t, "TEST_SCP", req.CalledAETitle)
+	require.NotNil(t, req.RemoteAddr)
+	require.Len(t, req.PresentationContexts, len(sopclass.VerificationClasses))
+	require.NotEmpty(t, req.UserInformation)
+}
+
+func TestCGetWithRoleSelection(t *testing.T) {
+	ds := mustReadTestDICOMFile("testdata/IM-0001-0003.dcm")
+	sp := startTestProvider(t, ServiceProviderParams{
+		CGet: func(ctx context.Context, conn ConnectionState, transferSyntaxUID string, sopClassUID string,
+			filters []*dicom.Element, ch chan CMoveResult) {
+			ch <- CMoveResult{Remaining: 0, Path: "IM-0001-0003.dcm", DataSet: ds}
+			close(ch)
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.QRGetClasses, TransferSyntaxes: testTransferSyntaxes})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	var received []string
+	err = su.CGet(QRLevelStudy,
+		[]*dicom.Element{dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3")},
+		func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			received = append(received, sopInstanceUID)
+			return dimse.Success
+		})
+	require.NoError(t, err)
+	require.Len(t, received, 1)
+}
+
+func TestConcurrentOperations(t *testing.T) {
+	ds := mustReadTestDICOMFile("testdata/IM-0001-0003.dcm")
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	sp := startTestProvider(t, ServiceProviderParams{
+		MaxOpsPerformed: 4,
+		CStore: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string,
+			dataReader io.Reader, dataSize int64) dimse.Status {
+			mu.Lock()
+			active++
+			if active > maxActive {
+				maxActive = active
+			}
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			active--
+			mu.Unlock()
+			return dimse.Success
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       append(append([]string{}, sopclass.StorageClasses...), sopclass.VerificationClasses...),
+		TransferSyntaxes: testTransferSyntaxes,
+		MaxOpsInvoked:    8,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			errs <- su.CStore(ds)
+		}()
+		go func() {
+			defer wg.Done()
+			errs <- su.CEcho()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		require.NoError(t, err)
+	}
+	require.Equal(t, 4, su.cm.maxOpsInvoked)
+	mu.Lock()
+	defer mu.Unlock()
+	require.True(t, maxActive > 1 && maxActive <= 4, "max concurrent C-STOREs: %d", maxActive)
+}
+
+func TestUserIdentity(t *testing.T) {
+	sp := startTestProvider(t, ServiceProviderParams{
+		AuthenticateUser: func(req AssociationRequest, identity *pdu_item.UserIdentitySubItem) ([]byte, error) {
+			if identity == nil {
+				return nil, fmt.Errorf("no identity")
+			}
+			switch identity.Type {
+			case pdu_item.UserIdentityUsernamePasscode:
+				if string(identity.PrimaryField) == "alice" && string(identity.SecondaryField) == "secret" {
+					return nil, nil
+				}
+			case pdu_item.UserIdentityKerberos:
+				return []byte("server-ticket"), nil
+			}
+			return nil, fmt.Errorf("bad credentials")
+		},
+	})
+
+	for _, test := range []struct {
+		identity *pdu_item.UserIdentitySubItem
+		ok       bool
+		response []byte
+	}{
+		{nil, false, nil},
+		{&pdu_item.UserIdentitySubItem{
+			Type:           pdu_item.UserIdentityUsernamePasscode,
+			PrimaryField:   []byte("alice"),
+			SecondaryField: []byte("wrong"),
+		}, false, nil},
+		{&pdu_item.UserIdentitySubItem{
+			Type:           pdu_item.UserIdentityUsernamePasscode,
+			PrimaryField:   []byte("alice"),
+			SecondaryField: []byte("secret"),
+		}, true, nil},
+		{&pdu_item.UserIdentitySubItem{
+			Type:                      pdu_item.UserIdentityKerberos,
+			PositiveResponseRequested: true,
+			PrimaryField:              []byte("client-ticket"),
+		}, true, []byte("server-ticket")},
+	} {
+		su, err := NewServiceUser(ServiceUserParams{
+			SOPClasses:   sopclass.VerificationClasses,
+			UserIdentity: test.identity,
+		})
+		require.NoError(t, err)
+		su.Connect(sp.ListenAddr().String())
+		err = su.CEcho()
+		if !test.ok {
+			require.Error(t, err)
+			su.Release()
+			continue
+		}
+		require.NoError(t, err)
+		response, err := su.UserIdentityResponse()
+		require.NoError(t, err)
+		require.Equal(t, test.response, response)
+		su.Release()
+	}
+}
+
+func TestCStoreMatchesTransferSyntax(t *testing.T) {
+	ds := mustReadTestDICOMFile("testdata/IM-0001-0003.dcm")
+	elem, err := ds.FindElementByTag(dicomtag.TransferSyntaxUID)
+	require.NoError(t, err)
+	dsTransferSyntaxUID, err := elem.GetString()
+	require.NoError(t, err)
+
+	var receivedTransferSyntaxUID string
+	sp := startTestProvider(t, ServiceProviderParams{
+		CStore: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string,
+			dataReader io.Reader, dataSize int64) dimse.Status {
+			receivedTransferSyntaxUID = transferSyntaxUID
+			return dimse.Success
+		},
+	})
+	// List the dataset's transfer syntax last, so that it wouldn't be
+	// picked without the per-transfer-syntax contexts.
+	var transferSyntaxes []string
+	for _, uid := range dicomio.StandardTransferSyntaxes {
+		if uid != dsTransferSyntaxUID {
+			transferSyntaxes = append(transferSyntaxes, uid)
+		}
+	}
+	transferSyntaxes = append(transferSyntaxes, dsTransferSyntaxUID)
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:               []string{"1.2.840.10008.5.1.4.1.1.2"},
+		TransferSyntaxes:         transferSyntaxes,
+		ContextPerTransferSyntax: true,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CStore(ds))
+	require.Equal(t, dsTransferSyntaxUID, receivedTransferSyntaxUID)
+}
+
+func TestCStoreWithSmallMaxPDUSize(t *testing.T) {
+	ds := mustReadTestDICOMFile("testdata/IM-0001-0003.dcm")
+	var receivedSize int64
+	sp := startTestProvider(t, ServiceProviderParams{
+		// The provider rejects PDUs much larger than this, so the client
+		// must split the dataset accordingly.
+		MaxPDUSize: 4096,
+		CStore: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string,
+			dataReader io.Reader, dataSize int64) dimse.Status {
+			n, err := io.Copy(io.Discard, dataReader)
+			if err != nil {
+				return dimse.Status{Status: dimse.CStoreOutOfResources}
+			}
+			receivedSize = n
+			return dimse.Success
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       []string{"1.2.840.10008.5.1.4.1.1.2"},
+		TransferSyntaxes: testTransferSyntaxes,
+		MaxPDUSize:       UnlimitedPDUSize,
+		MaxSendPDUSize:   2048,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CStore(ds))
+	require.True(t, receivedSize > 4096, "received %d bytes", receivedSize)
+}
+
+func TestCStoreStreaming(t *testing.T) {
+	ds := mustReadTestDICOMFile("testdata/IM-0001-0003.dcm")
+	store := func(streamingThreshold int64) ([]byte, int64) {
+		var data []byte
+		var size int64
+		sp := startTestProvider(t, ServiceProviderParams{
+			MaxPDUSize:         4096,
+			StreamingThreshold: streamingThreshold,
+			CStore: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string,
+				dataReader io.Reader, dataSize int64) dimse.Status {
+				var err error
+				size = dataSize
+				data, err = io.ReadAll(dataReader)
+				if err != nil {
+					return dimse.Status{Status: dimse.CStoreOutOfResources}
+				}
+				return dimse.Success
+			},
+		})
+		su, err := NewServiceUser(ServiceUserParams{SOPClasses: []string{"1.2.840.10008.5.1.4.1.1.2"}, TransferSyntaxes: testTransferSyntaxes})
+		require.NoError(t, err)
+		defer su.Release()
+		su.Connect(sp.ListenAddr().String())
+		require.NoError(t, su.CStore(ds))
+		return data, size
+	}
+	// Received in full, in memory.
+	buffered, size := store(-1)
+	require.Equal(t, int64(len(buffered)), size)
+	require.True(t, size > 8192, "received %d bytes", size)
+
+	// Streamed once 8 KB have arrived.
+	streamed, size := store(8192)
+	require.Equal(t, int64(-1), size)
+	require.Equal(t, buffered, streamed)
+}
+
+func TestCStoreContextCancelledOnAbort(t *testing.T) {
+	f, header, err := openDICOMFile("testdata/IM-0001-0003.dcm")
+	require.NoError(t, err)
+	data, err := io.ReadAll(f)
+	f.Close()
+	require.NoError(t, err)
+
+	started := make(chan struct{})
+	cancelled := make(chan bool, 1)
+	sp := startTestProvider(t, ServiceProviderParams{
+		StreamingThreshold: 1024,
+		CStore: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string,
+			dataReader io.Reader, dataSize int64) dimse.Status {
+			close(started)
+			// Fails once the association is aborted.
+			_, _ = io.Copy(io.Discard, dataReader)
+			select {
+			case <-ctx.Done():
+				cancelled <- true
+			case <-time.After(5 * time.Second):
+				cancelled <- false
+			}
+			return dimse.Success
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       []string{header.sopClassUID},
+		TransferSyntaxes: []string{header.transferSyntaxUID},
+		MaxSendPDUSize:   2048,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	// Send part of the data, then stall until ctx is cancelled, which aborts
+	// the association.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := io.MultiReader(bytes.NewReader(data[:8192]), readerFunc(func(p []byte) (int, error) {
+		<-ctx.Done()
+		return 0, ctx.Err()
+	}))
+	go func() {
+		<-started
+		cancel()
+	}()
+	err = su.CStoreStreamContext(ctx, header.sopClassUID, "1.2.3.4", header.transferSyntaxUID, r, int64(len(data)))
+	require.ErrorIs(t, err, context.Canceled)
+	require.True(t, <-cancelled)
+}
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+// Return a copy of ds with an extra element of "size" bytes.
+func withPadding(ds *dicom.DataSet, size int) *dicom.DataSet {
+	elems := append([]*dicom.Element{}, ds.Elements...)
+	elems = append(elems, dicom.MustNewElement(dicomtag.EncapsulatedDocument, make([]byte, size)))
+	return &dicom.DataSet{Elements: elems}
+}
+
+func TestCStoreSpoolQuota(t *testing.T) {
+	ds := mustReadTestDICOMFile("testdata/IM-0001-0003.dcm")
+	dir := t.TempDir()
+	stale := filepath.Join(dir, "dimse_data_stale")
+	require.NoError(t, os.WriteFile(stale, []byte("x"), 0644))
+
+	var mu sync.Mutex
+	var stored []int64
+	var modes []os.FileMode
+	sp := startTestProvider(t, ServiceProviderParams{
+		SpoolDir:              dir,
+		AssociationSpoolQuota: 4 << 20,
+		StreamingThreshold:    -1,
+		CStore: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string,
+			dataReader io.Reader, dataSize int64) dimse.Status {
+			paths, _ := filepath.Glob(filepath.Join(dir, "dimse_data_*"))
+			mu.Lock()
+			defer mu.Unlock()
+			for _, path := range paths {
+				info, err := os.Stat(path)
+				require.NoError(t, err)
+				modes = append(modes, info.Mode().Perm())
+			}
+			stored = append(stored, dataSize)
+			return dimse.Success
+		},
+	})
+	_, err := os.Stat(stale)
+	require.True(t, os.IsNotExist(err), "stale spool file should have been removed")
+
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: []string{"1.2.840.10008.5.1.4.1.1.2"}, TransferSyntaxes: testTransferSyntaxes})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	// Kept in memory.
+	require.NoError(t, su.CStore(ds))
+	// Spooled.
+	require.NoError(t, su.CStore(withPadding(ds, 2<<20)))
+	// Over the quota.
+	var statusErr *StatusError
+	require.ErrorAs(t, su.CStore(withPadding(ds, 5<<20)), &statusErr)
+	require.Equal(t, dimse.CStoreOutOfResources, statusErr.Status.Status)
+	// The quota has been released.
+	require.NoError(t, su.CStore(withPadding(ds, 2<<20)))
+
+	mu.Lock()
+	require.Len(t, stored, 3)
+	require.Equal(t, []os.FileMode{0600, 0600}, modes)
+	mu.Unlock()
+	paths, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+	require.Empty(t, paths)
+}
+
+func TestDIMSETimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	sp := startTestProvider(t, ServiceProviderParams{
+		CEcho: func(ctx context.Context, conn ConnectionState) dimse.Status {
+			<-release
+			return dimse.Success
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:   sopclass.VerificationClasses,
+		DIMSETimeout: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, su.CEcho(), &timeoutErr)
+	require.Equal(t, "C-ECHO response", timeoutErr.Op)
+	// The association has been aborted.
+	require.ErrorAs(t, su.CEcho(), &timeoutErr)
+}
+
+func TestOperationContext(t *testing.T) {
+	ds := mustReadTestDICOMFile("testdata/IM-0001-0003.dcm")
+	echoDone := make(chan struct{})
+	sp := startTestProvider(t, ServiceProviderParams{
+		CEcho: func(ctx context.Context, conn ConnectionState) dimse.Status {
+			// Stall until the client aborts the association.
+			<-ctx.Done()
+			close(echoDone)
+			return dimse.Success
+		},
+		CStore: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string,
+			dataReader io.Reader, dataSize int64) dimse.Status {
+			return dimse.Success
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       append(append([]string{}, sopclass.VerificationClasses...), sopclass.StorageClasses...),
+		TransferSyntaxes: testTransferSyntaxes,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	// A done context doesn't affect the association.
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, su.CStoreContext(cancelled, ds))
+	require.NoError(t, su.CStoreContext(context.Background(), ds))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, su.CEchoContext(ctx))
+	select {
+	case <-echoDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("C-ECHO callback didn't see the abort")
+	}
+	// The association has been aborted.
+	require.Equal(t, context.DeadlineExceeded, su.CStore(ds))
+}
+
+func TestIdleTimeout(t *testing.T) {
+	sp := startTestProvider(t, ServiceProviderParams{})
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:  sopclass.VerificationClasses,
+		IdleTimeout: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CEcho())
+	time.Sleep(300 * time.Millisecond)
+
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, su.CEcho(), &timeoutErr)
+	require.Equal(t, "idle association", timeoutErr.Op)
+}
+
+func TestARTIMTimeout(t *testing.T) {
+	// A server that accepts connections but never answers A-ASSOCIATE-RQ.
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:   sopclass.VerificationClasses,
+		ARTIMTimeout: 100 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(listener.Addr().String())
+
+	var timeoutErr *TimeoutError
+	require.ErrorAs(t, su.CEcho(), &timeoutErr)
+	require.Equal(t, "A-ASSOCIATE response", timeoutErr.Op)
+}
+
+func TestConnectionState(t *testing.T) {
+	states := make(chan ConnectionState, 2)
+	sp := startTestProvider(t, ServiceProviderParams{
+		CEcho: func(ctx context.Context, conn ConnectionState) dimse.Status {
+			states <- conn
+			return dimse.Success
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{
+		CalledAETitle:    "TEST_SCP",
+		CallingAETitle:   "MODALITY1",
+		SOPClasses:       sopclass.VerificationClasses,
+		TransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+		MaxPDUSize:       32768,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	require.NoError(t, su.CEcho())
+	require.NoError(t, su.CEcho())
+
+	state := <-states
+	require.Equal(t, "MODALITY1", state.CallingAETitle)
+	require.Equal(t, "TEST_SCP", state.CalledAETitle)
+	require.Equal(t, sp.ListenAddr().String(), state.LocalAddr.String())
+	require.NotNil(t, state.RemoteAddr)
+	require.Equal(t, dicom.GoDICOMImplementationClassUID, state.PeerImplementationClassUID)
+	require.Equal(t, dicom.GoDICOMImplementationVersionName, state.PeerImplementationVersionName)
+	require.Equal(t, 32768, state.MaxPDUSize)
+	require.Equal(t, []PresentationContext{{
+		ID:                1,
+		AbstractSyntaxUID: dicomuid.VerificationSOPClass,
+		TransferSyntaxUID: dicomuid.ImplicitVRLittleEndian,
+	}}, state.PresentationContexts)
+	require.NotEmpty(t, state.AssociationID)
+	// Both calls run on the same association.
+	require.Equal(t, state.AssociationID, (<-states).AssociationID)
+}
+
+func TestAssociationAborted(t *testing.T) {
+	// A server that aborts every association request.
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if _, err := pdu.ReadPDU(conn, DefaultMaxPDUSize); err != nil {
+				conn.Close()
+				continue
+			}
+			data, err := pdu.EncodePDU(&pdu.AAbort{Source: 2, Reason: pdu.AbortReasonUnexpectedPDU})
+			if err == nil {
+				_, _ = conn.Write(data)
+			}
+			defer conn.Close()
+		}
+	}()
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(listener.Addr().String())
+
+	var aborted *AssociationAbortedError
+	require.ErrorAs(t, su.CEcho(), &aborted)
+	require.Equal(t, pdu.SourceType(2), aborted.Source)
+	require.Equal(t, pdu.AbortReasonUnexpectedPDU, aborted.Reason)
+}
+
+func TestConnectContext(t *testing.T) {
+	params := ServiceProviderParams{
+		AETitle: "TEST_SCP",
+		CEcho:   func(ctx context.Context, conn ConnectionState) dimse.Status { return dimse.Success },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var dialedAddr string
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: sopclass.VerificationClasses,
+		Dialer: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialedAddr = address
+			clientConn, serverConn := net.Pipe()
+			go RunProviderForConn(ctx, serverConn, params)
+			return clientConn, nil
+		},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	require.NoError(t, su.ConnectContext(ctx, "pipe:104"))
+	require.Equal(t, "pipe:104", dialedAddr)
+	require.NoError(t, su.CEcho())
+	require.Error(t, su.ConnectContext(ctx, "pipe:104"))
+}
+
+func TestConnectContextErrors(t *testing.T) {
+	dialErr := fmt.Errorf("no route to host")
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: sopclass.VerificationClasses,
+		Dialer: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return nil, dialErr
+		},
+	})
+	require.NoError(t, err)
+	require.Equal(t, dialErr, su.ConnectContext(context.Background(), "localhost:104"))
+	require.Equal(t, dialErr, su.CEcho())
+	su.Release()
+
+	// A server that never answers A-ASSOCIATE-RQ.
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	su, err = NewServiceUser(ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.Equal(t, context.DeadlineExceeded, su.ConnectContext(ctx, listener.Addr().String()))
+	require.Equal(t, context.DeadlineExceeded, su.CEcho())
+}
+
+// Create a self-signed certificate for "localhost", and return the TLS configs
+// for a server presenting it and for a client trusting it.
+func newTestTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{RootCAs: pool}
+	return server, client
+}
+
+func TestTLS(t *testing.T) {
+	serverTLS, clientTLS := newTestTLSConfigs(t)
+	sp := startTestProvider(t, ServiceProviderParams{TLSConfig: serverTLS})
+	_, port, err := net.SplitHostPort(sp.ListenAddr().String())
+	require.NoError(t, err)
+	addr := net.JoinHostPort("localhost", port)
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: sopclass.VerificationClasses,
+		TLSConfig:  clientTLS,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	require.NoError(t, su.ConnectContext(context.Background(), addr))
+	require.NoError(t, su.CEcho())
+
+	// A client without TLS cannot talk to the server.
+	su2, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:   sopclass.VerificationClasses,
+		ARTIMTimeout: time.Second,
+	})
+	require.NoError(t, err)
+	defer su2.Release()
+	require.Error(t, su2.ConnectContext(context.Background(), addr))
+}
+
+func TestCMoveSubOperationsOverTLS(t *testing.T) {
+	serverTLS, clientTLS := newTestTLSConfigs(t)
+	ds := mustReadTestDICOMFile("testdata/IM-0001-0003.dcm")
+	var mu sync.Mutex
+	var stored []ConnectionState
+	dest := startTestProvider(t, ServiceProviderParams{
+		AETitle:   "DEST",
+		TLSConfig: serverTLS,
+		CStore: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string,
+			dataReader io.Reader, dataSize int64) dimse.Status {
+			mu.Lock()
+			stored = append(stored, conn)
+			mu.Unlock()
+			return dimse.Success
+		},
+	})
+	_, port, err := net.SplitHostPort(dest.ListenAddr().String())
+	require.NoError(t, err)
+
+	// This is what the C-MOVE handler runs for each dataset, given
+	// RemoteAEs and RemoteAETLSConfigs.
+	params := ServiceProviderParams{
+		AETitle:            "TEST_SCP",
+		RemoteAEs:          map[string]string{"DEST": net.JoinHostPort("localhost", port)},
+		RemoteAETLSConfigs: map[string]*tls.Config{"DEST": clientTLS},
+	}
+	ctx := context.Background()
+	require.NoError(t, runCStoreOnNewAssociation(ctx, params.AETitle, "DEST", params.RemoteAEs["DEST"],
+		params.RemoteAETLSConfigs["DEST"], nil, ds))
+	require.Error(t, runCStoreOnNewAssociation(ctx, params.AETitle, "DEST", params.RemoteAEs["DEST"], nil, nil, ds))
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, stored, 1)
+	require.Equal(t, "TEST_SCP", stored[0].CallingAETitle)
+	require.NotZero(t, stored[0].TLS.Version)
+}
+
+func TestCMove(t *testing.T) {
+	ds := mustReadTestDICOMFile("testdata/IM-0001-0003.dcm")
+	sopInstanceUID, err := getSOPInstanceUID(ds)
+	require.NoError(t, err)
+
+	var mu sync.Mutex
+	var stored []string
+	dest := startTestProvider(t, ServiceProviderParams{
+		AETitle: "DEST",
+		CStore: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string,
+			dataReader io.Reader, dataSize int64) dimse.Status {
+			mu.Lock()
+			stored = append(stored, sopInstanceUID)
+			mu.Unlock()
+			return dimse.Success
+		},
+	})
+	// A destination that refuses connections.
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	brokenAddr := listener.Addr().String()
+	listener.Close()
+
+	sp := startTestProvider(t, ServiceProviderParams{
+		RemoteAEs: map[string]string{
+			"DEST":   dest.ListenAddr().String(),
+			"BROKEN": brokenAddr,
+		},
+		CMove: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CMoveResult) {
+			ch <- CMoveResult{Remaining: 1, Path: "a.dcm", DataSet: ds}
+			ch <- CMoveResult{Remaining: 0, Path: "b.dcm", DataSet: ds}
+			close(ch)
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.QRMoveClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	filter := []*dicom.Element{dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3")}
+	var progress []CMoveProgress
+	for p := range su.CMove(context.Background(), QRLevelStudy, filter, "DEST") {
+		progress = append(progress, p)
+	}
+	require.Len(t, progress, 3)
+	require.Equal(t, CMoveProgress{Status: dimse.Status{Status: dimse.StatusPending}, Remaining: 1, Completed: 1}, progress[0])
+	final := progress[2]
+	require.NoError(t, final.Err)
+	require.True(t, final.Final)
+	require.Equal(t, dimse.StatusSuccess, final.Status.Status)
+	require.Equal(t, 2, final.Completed)
+	mu.Lock()
+	require.Equal(t, []string{sopInstanceUID, sopInstanceUID}, stored)
+	mu.Unlock()
+
+	progress = nil
+	for p := range su.CMove(context.Background(), QRLevelStudy, filter, "BROKEN") {
+		progress = append(progress, p)
+	}
+	final = progress[len(progress)-1]
+	require.NoError(t, final.Err)
+	require.Equal(t, dimse.CMoveSubOperationsCompleteWithFailures, final.Status.Status)
+	require.Equal(t, 2, final.Failed)
+	require.Equal(t, []string{sopInstanceUID, sopInstanceUID}, final.FailedSOPInstanceUIDs)
+
+	// The server doesn't know the destination.
+	progress = nil
+	for p := range su.CMove(context.Background(), QRLevelStudy, filter, "UNKNOWN") {
+		progress = append(progress, p)
+	}
+	require.Len(t, progress, 1)
+	require.Error(t, progress[0].Err)
+	require.True(t, progress[0].Final)
+}
+
+func TestCFindCancel(t *testing.T) {
+	cancelled := make(chan struct{})
+	sp := startTestProvider(t, ServiceProviderParams{
+		CFind: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CFindResult) {
+			defer close(ch)
+			for {
+				select {
+				case <-ctx.Done():
+					close(cancelled)
+					return
+				case ch <- CFindResult{Elements: []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "foo")}}:
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: append(append([]string{}, sopclass.QRFindClasses...), sopclass.VerificationClasses...),
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	filter := []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "*")}
+	var results []CFindResult
+	for result := range su.CFindContext(ctx, QRLevelPatient, filter) {
+		results = append(results, result)
+		if len(results) == 3 {
+			cancel()
+		}
+	}
+	require.Greater(t, len(results), 3)
+	for _, result := range results[:len(results)-1] {
+		require.NoError(t, result.Err)
+	}
+	require.ErrorIs(t, results[len(results)-1].Err, context.Canceled)
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("C-FIND callback didn't see the cancellation")
+	}
+	// The association survives the cancellation.
+	require.NoError(t, su.CEcho())
+}
+
+func TestCMoveCancel(t *testing.T) {
+	ds := mustReadTestDICOMFile("testdata/IM-0001-0003.dcm")
+	dest := startTestProvider(t, ServiceProviderParams{
+		AETitle: "DEST",
+		CStore: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string,
+			dataReader io.Reader, dataSize int64) dimse.Status {
+			return dimse.Success
+		},
+	})
+	sp := startTestProvider(t, ServiceProviderParams{
+		RemoteAEs: map[string]string{"DEST": dest.ListenAddr().String()},
+		CMove: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CMoveResult) {
+			defer close(ch)
+			for i := 0; i < 1000; i++ {
+				select {
+				case <-ctx.Done():
+					return
+				case ch <- CMoveResult{Remaining: 999 - i, Path: "a.dcm", DataSet: ds}:
+				}
+			}
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.QRMoveClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	filter := []*dicom.Element{dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3")}
+	var progress []CMoveProgress
+	for p := range su.CMove(ctx, QRLevelStudy, filter, "DEST") {
+		progress = append(progress, p)
+		if len(progress) == 2 {
+			cancel()
+		}
+	}
+	final := progress[len(progress)-1]
+	require.True(t, final.Final)
+	require.ErrorIs(t, final.Err, context.Canceled)
+	require.Equal(t, dimse.StatusCancel, final.Status.Status)
+	require.Greater(t, final.Remaining, 0)
+	require.Less(t, final.Completed, 1000)
+}
+
+func TestCFindFailureStatus(t *testing.T) {
+	sp := startTestProvider(t, ServiceProviderParams{
+		CFind: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CFindResult) {
+			ch <- CFindResult{Err: fmt.Errorf("database is down")}
+			close(ch)
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: append(append([]string{}, sopclass.QRFindClasses...), sopclass.VerificationClasses...),
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	filter := []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "*")}
+	var results []CFindResult
+	for result := range su.CFind(QRLevelPatient, filter) {
+		results = append(results, result)
+	}
+	require.Len(t, results, 1)
+	var statusErr *StatusError
+	require.ErrorAs(t, results[0].Err, &statusErr)
+	require.Equal(t, dimse.CFindUnableToProcess, statusErr.Status.Status)
+	require.Equal(t, "database is down", statusErr.Status.ErrorComment)
+	require.NoError(t, su.CEcho())
+}
+
+func TestBlankAETitleRejected(t *testing.T) {
+	sp := startTestProvider(t, ServiceProviderParams{})
+	for _, test := range []struct {
+		calling, called string
+		reason          pdu.RejectReasonType
+	}{
+		{" ", "SCP", pdu.RejectReasonCallingAETitleNotRecognized},
+		{"SCU", " ", pdu.RejectReasonCalledAETitleNotRecognized},
+	} {
+		conn, err := net.Dial("tcp", sp.ListenAddr().String())
+		require.NoError(t, err)
+		data, err := pdu.EncodePDU(&pdu.AAssociateRQ{
+			ProtocolVersion: pdu.CurrentProtocolVersion,
+			CallingAETitle:  test.calling,
+			CalledAETitle:   test.called,
+		})
+		require.NoError(t, err)
+		_, err = conn.Write(data)
+		require.NoError(t, err)
+		resp, err := pdu.ReadPDU(conn, 0)
+		require.NoError(t, err)
+		rj, ok := resp.(*pdu.AAssociateRj)
+		require.True(t, ok, "got %v", resp)
+		require.Equal(t, test.reason, rj.Reason)
+		conn.Close()
+	}
+}
+
+func TestAssociationWithoutPresentationContextRejected(t *testing.T) {
+	sp := startTestProvider(t, ServiceProviderParams{})
+	conn, err := net.Dial("tcp", sp.ListenAddr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	data, err := pdu.EncodePDU(&pdu.AAssociateRQ{
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CallingAETitle:  "SCU",
+		CalledAETitle:   "SCP",
+		Items: []pdu_item.SubItem{
+			&pdu_item.ApplicationContextItem{Name: pdu_item.DICOMApplicationContextItemName},
+			&pdu_item.UserInformationItem{Items: []pdu_item.SubItem{
+				&pdu_item.UserInformationMaximumLengthItem{MaximumLengthReceived: 16384},
+			}},
+		},
+	})
+	require.NoError(t, err)
+	_, err = conn.Write(data)
+	require.NoError(t, err)
+	resp, err := pdu.ReadPDU(conn, 0)
+	require.NoError(t, err)
+	rj, ok := resp.(*pdu.AAssociateRj)
+	require.True(t, ok, "got %v", resp)
+	require.Equal(t, pdu.ResultRejectedPermanent, rj.Result)
+}
@@ -5,13 +5,20 @@ package netdicom
 //go:generate stringer -type QRLevel
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/algm/go-netdicom/commandset"
 	"github.com/algm/go-netdicom/dimse"
+	"github.com/algm/go-netdicom/pdu/pdu_item"
 	"github.com/grailbio/go-dicom"
 	"github.com/grailbio/go-dicom/dicomio"
 	"github.com/grailbio/go-dicom/dicomlog"
@@ -38,20 +45,45 @@ const (
 //	// Disconnect
 //	user.Release()
 //
-// The ServiceUser class is thread compatible. That is, you cannot call C*
-// methods - say CStore and CFind requests - concurrently from two goroutines.
-// You must wait for CStore to finish before issuing CFind.
+// The ServiceUser class is thread safe. C* methods may be called concurrently
+// from multiple goroutines. They are multiplexed on the association, up to the
+// asynchronous operations window negotiated with the server (see
+// ServiceUserParams.MaxOpsInvoked); when the window is full, a call blocks
+// until another operation finishes. CGet calls are serialized regardless of
+// the window.
+//
+// When the association cannot be established or ends abnormally, the C*
+// methods return *AssociationRejectedError, *AssociationAbortedError, or
+// *TimeoutError.
 type ServiceUser struct {
-	label    string // For  logging
-	upcallCh chan upcallEvent
+	label  string // For  logging
+	params ServiceUserParams
 
 	mu   *sync.Mutex
 	cond *sync.Cond // Broadcast when status changes.
 	disp *serviceDispatcher
 
+	// Serializes CGet calls, since the C-STORE sub-operations of different
+	// C-GETs cannot be told apart.
+	cgetMu sync.Mutex
+
 	// Following fields are guarded by mu.
 	status serviceUserStatus
 	cm     *contextManager // Set only after the handshake completes.
+	// Limits the number of outstanding operations to the negotiated
+	// window. Set along with cm. Nil if the window is unlimited.
+	opsWindow chan struct{}
+	// The error that ended the association, e.g., a *TimeoutError. Nil if
+	// the association ended normally or is still active.
+	err error
+	// The number of DIMSE operations started, and of those still running.
+	numOps      int
+	numInFlight int
+	// The address passed to Connect or ConnectContext. Used to reconnect.
+	serverAddr string
+	// Closed when the state machine and the upcall dispatcher of the current
+	// association have finished.
+	done chan struct{}
 	// activeCommands map[uint16]*userCommandState // List of commands running
 }
 
@@ -67,15 +99,102 @@ type ServiceUserParams struct {
 	// the constants listed in sopclass package.
 	SOPClasses []string
 
-	// List of Transfer syntaxes supported by the user.  If you know the
-	// transer syntax of the file you are going to copy, set that here.
-	// Otherwise, you'll need to re-encode the data w/ the given transfer
-	// syntax yourself.
-	//
-	// TODO(saito) Support reencoding internally on C_STORE, etc. The DICOM
-	// spec is particularly moronic here, since we could just have specified
-	// the transfer syntax per data sent.
+	// List of Transfer syntaxes supported by the user. If empty, set to
+	// dicomio.StandardTransferSyntaxes. CStore converts the data among the
+	// uncompressed transfer syntaxes (implicit and explicit VR little endian,
+	// explicit VR big endian, and deflated explicit VR little endian) when
+	// the server accepted a different one. Data in a compressed transfer
+	// syntax, e.g., JPEG, can't be converted, so if you are going to send
+	// such data, list its transfer syntax here.
 	TransferSyntaxes []string
+
+	// ContextPerTransferSyntax, if true, makes the client propose one
+	// presentation context per (SOP class, transfer syntax) pair, instead of
+	// one context per SOP class listing all the transfer syntaxes. Use it
+	// with servers that accept only one transfer syntax per context, so that
+	// every transfer syntax they support becomes usable. CStore picks the
+	// context matching the dataset's transfer syntax. At most 128 contexts
+	// can be proposed, i.e., len(SOPClasses)*len(TransferSyntaxes) <= 128.
+	ContextPerTransferSyntax bool
+
+	// MaxOpsInvoked is the number of DIMSE operations the client wishes to
+	// have outstanding at the same time, proposed to the server through the
+	// asynchronous operations window (P3.7 D.3.3.3). The server may lower
+	// it. Zero or one disables asynchronous operations, i.e., operations run
+	// one at a time.
+	MaxOpsInvoked int
+
+	// MaxPDUSize is the maximum PDU size, in bytes, the client advertises to
+	// the server, and the largest PDU it accepts. Zero means
+	// DefaultMaxPDUSize. UnlimitedPDUSize advertises no limit.
+	MaxPDUSize int
+
+	// MaxSendPDUSize, if positive, caps the size of the PDUs sent to the
+	// server below what the server advertises.
+	MaxSendPDUSize int
+
+	// Dialer, if non-nil, opens the connection to the server in Connect and
+	// ConnectContext. It is called with network "tcp" and the address passed
+	// to Connect. Use it to bind a source address, e.g.,
+	//
+	//	Dialer: (&net.Dialer{LocalAddr: localAddr}).DialContext,
+	//
+	// or to tunnel through a proxy. If nil, net.Dialer is used.
+	Dialer func(ctx context.Context, network, address string) (net.Conn, error)
+
+	// TLSConfig, if non-nil, makes the client talk to the server over TLS,
+	// as in the DICOM TLS secure transport connection profile (P3.15 B.1).
+	// If TLSConfig.ServerName is empty, the host part of the address passed
+	// to Connect is used to verify the server certificate.
+	TLSConfig *tls.Config
+
+	// ConnectTimeout, if positive, limits the time Connect spends
+	// establishing the TCP connection, including the TLS handshake.
+	ConnectTimeout time.Duration
+
+	// ARTIMTimeout is how long the client waits for the server to answer
+	// A-ASSOCIATE-RQ, and for the connection to close after a release or an
+	// abort (P3.8 9.1.5). Zero means 10 seconds.
+	ARTIMTimeout time.Duration
+
+	// DIMSETimeout, if positive, is how long an operation waits for each
+	// response message from the server, e.g., each C-FIND result.
+	DIMSETimeout time.Duration
+
+	// IdleTimeout, if positive, aborts the association when no PDU has been
+	// sent or received for this long.
+	//
+	// When any of the above timeouts expires, the association is aborted and
+	// the pending and subsequent operations fail with *TimeoutError.
+	IdleTimeout time.Duration
+
+	// RetryPolicy, if set, retries failed C-STOREs, reconnecting if the
+	// association was lost.
+	RetryPolicy *RetryPolicy
+
+	// UserIdentity, if non-nil, is sent to the server in A-ASSOCIATE-RQ to
+	// identify the user, e.g.,
+	//
+	//	&pdu_item.UserIdentitySubItem{
+	//		Type:           pdu_item.UserIdentityUsernamePasscode,
+	//		PrimaryField:   []byte("user"),
+	//		SecondaryField: []byte("passcode"),
+	//	}
+	//
+	// Set PositiveResponseRequested to receive the server's response, which
+	// is available through UserIdentityResponse.
+	UserIdentity *pdu_item.UserIdentitySubItem
+
+	// SOPClassExtendedNegotiation lists the service-class specific features
+	// the client proposes, e.g., relational queries or fuzzy semantic
+	// matching of person names for C-FIND (P3.4 C.3.5). The features
+	// accepted by the server are available through ExtendedNegotiation.
+	SOPClassExtendedNegotiation []*pdu_item.SOPClassExtendedNegotiationSubItem
+
+	// SOPClassCommonExtendedNegotiation tells the server the service class
+	// and the related general SOP classes of the proposed SOP classes
+	// (P3.7 D.3.3.6).
+	SOPClassCommonExtendedNegotiation []*pdu_item.SOPClassCommonExtendedNegotiationSubItem
 }
 
 func validateServiceUserParams(params *ServiceUserParams) error {
@@ -88,20 +207,55 @@ func validateServiceUserParams(params *ServiceUserParams) error {
 	if len(params.SOPClasses) == 0 {
 		return fmt.Errorf("Empty ServiceUserParams.SOPClasses")
 	}
+	if id := params.UserIdentity; id != nil {
+		if id.Type < pdu_item.UserIdentityUsername || id.Type > pdu_item.UserIdentityJWT {
+			return fmt.Errorf("Invalid ServiceUserParams.UserIdentity.Type: %v", id.Type)
+		}
+		if len(id.PrimaryField) == 0 {
+			return fmt.Errorf("Empty ServiceUserParams.UserIdentity.PrimaryField")
+		}
+		if (id.Type == pdu_item.UserIdentityUsernamePasscode) != (len(id.SecondaryField) > 0) {
+			return fmt.Errorf("ServiceUserParams.UserIdentity.SecondaryField must be set iff Type is UserIdentityUsernamePasscode")
+		}
+	}
+	if params.MaxOpsInvoked < 0 || params.MaxOpsInvoked > math.MaxUint16 {
+		return fmt.Errorf("ServiceUserParams.MaxOpsInvoked out of range: %d", params.MaxOpsInvoked)
+	}
+	if err := validateMaxPDUSize(params.MaxPDUSize, params.MaxSendPDUSize); err != nil {
+		return err
+	}
 	if len(params.TransferSyntaxes) == 0 {
 		params.TransferSyntaxes = dicomio.StandardTransferSyntaxes
 	} else {
 		for i, uid := range params.TransferSyntaxes {
+			// Drop the padding of an encoded UID.
+			uid = strings.TrimRight(uid, " \x00")
 			canonicalUID, err := dicomio.CanonicalTransferSyntaxUID(uid)
 			if err != nil {
 				return err
 			}
+			if !isNativeTransferSyntax(uid) {
+				// Encapsulated transfer syntaxes, e.g., JPEG, are
+				// proposed as is, since their data cannot be
+				// re-encoded in canonicalUID.
+				canonicalUID = uid
+			}
 			params.TransferSyntaxes[i] = canonicalUID
 		}
 	}
+	numContexts := len(params.SOPClasses)
+	if params.ContextPerTransferSyntax {
+		numContexts *= len(params.TransferSyntaxes)
+	}
+	if numContexts > maxPresentationContexts {
+		return fmt.Errorf("Too many presentation contexts: %d proposed, at most %d allowed", numContexts, maxPresentationContexts)
+	}
 	return nil
 }
 
+// Context IDs are odd numbers in [1, 255] (P3.8 9.3.2.2).
+const maxPresentationContexts = 128
+
 // NewServiceUser creates a new ServiceUser. The caller must call either
 // Connect() or SetConn() before calling any other method, such as Cstore.
 func NewServiceUser(params ServiceUserParams) (*ServiceUser, error) {
@@ -113,26 +267,56 @@ func NewServiceUser(params ServiceUserParams) (*ServiceUser, error) {
 	mu := &sync.Mutex{}
 	label := newUID("user")
 	su := &ServiceUser{
-		label:    label,
-		upcallCh: make(chan upcallEvent, 128),
-		disp:     newServiceDispatcher(label),
-		mu:       mu,
-		cond:     sync.NewCond(mu),
-		status:   serviceUserInitial,
-	}
-	go runStateMachineForServiceUser(params, su.upcallCh, su.disp.downcallCh, label)
+		label:  label,
+		params: params,
+		disp:   newServiceDispatcher(label),
+		mu:     mu,
+		cond:   sync.NewCond(mu),
+		status: serviceUserInitial,
+	}
+	su.start()
+	return su, nil
+}
+
+// Start the state machine for a new association, and a goroutine that
+// dispatches its upcalls. The dispatcher is shared by all the associations of
+// su, one at a time.
+func (su *ServiceUser) start() {
+	upcallCh := make(chan upcallEvent, 128)
+	done := make(chan struct{})
+	su.done = done
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		runStateMachineForServiceUser(su.params, upcallCh, su.disp.downcallCh, su.label)
+		wg.Done()
+	}()
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
 	go func() {
-		for event := range su.upcallCh {
+		defer wg.Done()
+		for event := range upcallCh {
 			if event.eventType == upcallEventHandshakeCompleted {
 				su.mu.Lock()
-				doassert(su.cm == nil)
-				su.status = serviceUserAssociationActive
+				if su.status == serviceUserInitial {
+					// Not aborted during the handshake.
+					su.status = serviceUserAssociationActive
+				}
 				su.cond.Broadcast()
 				su.cm = event.cm
 				doassert(su.cm != nil)
+				if n := su.cm.maxOpsInvoked; n > 0 {
+					su.opsWindow = make(chan struct{}, n)
+				}
 				su.mu.Unlock()
 				continue
 			}
+			if event.eventType == upcallEventError {
+				su.setError(event.err)
+				continue
+			}
 			doassert(event.eventType == upcallEventData)
 			su.disp.handleEvent(event)
 		}
@@ -143,16 +327,46 @@ func NewServiceUser(params ServiceUserParams) (*ServiceUser, error) {
 		su.status = serviceUserClosed
 		su.mu.Unlock()
 	}()
-	return su, nil
 }
 
 func (su *ServiceUser) waitUntilReady() error {
+	return su.waitUntilReadyContext(context.Background())
+}
+
+// Wait until the association handshake finishes, or until ctx is done, in
+// which case the association is aborted.
+func (su *ServiceUser) waitUntilReadyContext(ctx context.Context) error {
+	if ctx.Done() != nil {
+		// Wake up the wait below when ctx is done.
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				su.mu.Lock()
+				su.cond.Broadcast()
+				su.mu.Unlock()
+			case <-stop:
+			}
+		}()
+	}
 	su.mu.Lock()
-	defer su.mu.Unlock()
-	for su.status <= serviceUserInitial {
+	for su.status <= serviceUserInitial && ctx.Err() == nil {
 		su.cond.Wait()
 	}
+	if su.status <= serviceUserInitial {
+		su.mu.Unlock()
+		err := ctx.Err()
+		dicomlog.Vprintf(0, "dicom.serviceUser(%s): %v; aborting", su.label, err)
+		su.setError(err)
+		su.disp.downcallCh <- stateEvent{event: evt15, err: err}
+		return err
+	}
+	defer su.mu.Unlock()
 	if su.status != serviceUserAssociationActive {
+		if su.err != nil {
+			return su.err
+		}
 		// Will get an error when waiting for a response.
 		dicomlog.Vprintf(0, "dicom.serviceUser: Connection failed")
 		return fmt.Errorf("dicom.serviceUser: Connection failed")
@@ -160,40 +374,279 @@ func (su *ServiceUser) waitUntilReady() error {
 	return nil
 }
 
+// Take a slot in the asynchronous operations window, blocking while the window
+// is full. Returns the window the slot was taken from, which the caller must
+// pass to releaseOp when the operation finishes. A reconnect replaces
+// su.opsWindow, so the slot is returned to the window it came from.
+//
+// REQUIRES: waitUntilReady has succeeded.
+func (su *ServiceUser) acquireOp() chan struct{} {
+	su.mu.Lock()
+	su.numOps++
+	su.numInFlight++
+	window := su.opsWindow
+	su.mu.Unlock()
+	if window != nil {
+		window <- struct{}{}
+	}
+	return window
+}
+
+func (su *ServiceUser) releaseOp(window chan struct{}) {
+	if window != nil {
+		<-window
+	}
+	su.mu.Lock()
+	su.numInFlight--
+	su.mu.Unlock()
+}
+
+// Record that the association has been closed by the peer.
+func (su *ServiceUser) markClosed() {
+	su.mu.Lock()
+	su.status = serviceUserClosed
+	su.cond.Broadcast()
+	su.mu.Unlock()
+}
+
+// Return the number of DIMSE operations started so far.
+func (su *ServiceUser) numOperations() int {
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	return su.numOps
+}
+
+// Record that the association has ended because of "err". Only the first
+// error is kept.
+func (su *ServiceUser) setError(err error) {
+	su.mu.Lock()
+	if su.err == nil {
+		su.err = err
+	}
+	su.status = serviceUserClosed
+	su.cond.Broadcast()
+	su.mu.Unlock()
+}
+
+// Wait for the next message for "cs", for at most DIMSETimeout. "op" names the
+// awaited message in errors. If ctx is done first and the operation is
+// cancellable, C-CANCEL-RQ is sent for "cs" and the wait continues; the server
+// then ends the operation with dimse.StatusCancel. Otherwise the association
+// is aborted.
+func (su *ServiceUser) readResponse(ctx context.Context, cs *serviceCommandState, op string, cancellable bool) (upcallEvent, error) {
+	for {
+		readCtx := ctx
+		if cs.cancelSent {
+			readCtx = context.Background()
+		}
+		event, err := readUpcall(readCtx, cs.upcallCh, su.params.DIMSETimeout, op)
+		if err != nil && cancellable && !cs.cancelSent && err == ctx.Err() {
+			dicomlog.Vprintf(0, "dicom.serviceUser(%s): %v; cancelling command %v", su.label, err, cs.messageID)
+			cs.sendMessage(&dimse.CCancelRq{
+				MessageIDBeingRespondedTo: cs.messageID,
+				CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			}, nil)
+			cs.cancelSent = true
+			continue
+		}
+		if err != nil {
+			return event, su.handleAssociationError(err)
+		}
+		return event, nil
+	}
+}
+
+// Return the error to report when an operation on "cs" ends with
+// dimse.StatusCancel.
+func cancelledError(ctx context.Context, cs *serviceCommandState, op string) error {
+	if cs.cancelSent && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return fmt.Errorf("%s cancelled by the server", op)
+}
+
+// Update the association state after an operation fails with "err", and
+// return the error to report to the caller. A timeout, or the caller's context
+// being done, aborts the association. When the association has already ended,
+// the error that ended it is reported.
+func (su *ServiceUser) handleAssociationError(err error) error {
+	var timeoutErr *TimeoutError
+	switch {
+	case errors.As(err, &timeoutErr), err == context.Canceled, err == context.DeadlineExceeded:
+		dicomlog.Vprintf(0, "dicom.serviceUser(%s): %v; aborting", su.label, err)
+		su.setError(err)
+		su.disp.downcallCh <- stateEvent{event: evt15, err: err}
+	case errors.Is(err, errConnectionClosed):
+		su.markClosed()
+		su.mu.Lock()
+		defer su.mu.Unlock()
+		if su.err != nil {
+			return su.err
+		}
+	}
+	return err
+}
+
 // Connect connects to the server at the given "host:port". Either Connect or
-// SetConn must be before calling CStore, etc.
+// SetConn must be before calling CStore, etc. Errors are reported by the
+// subsequent calls. Use ConnectContext to learn them right away.
 func (su *ServiceUser) Connect(serverAddr string) {
-	if su.status != serviceUserInitial {
-		panic(fmt.Sprintf("dicom.serviceUser: Connect called with wrong state: %v", su.status))
+	if status := su.getStatus(); status != serviceUserInitial {
+		panic(fmt.Sprintf("dicom.serviceUser: Connect called with wrong state: %v", status))
+	}
+	_ = su.dial(context.Background(), serverAddr)
+}
+
+// ConnectContext connects to the server at the given "host:port" and waits for
+// the association handshake to finish. It returns nil iff the association is
+// established. If ctx is done before then, the association is aborted and
+// ctx.Err() is returned.
+func (su *ServiceUser) ConnectContext(ctx context.Context, serverAddr string) error {
+	if status := su.getStatus(); status != serviceUserInitial {
+		return fmt.Errorf("dicom.serviceUser: ConnectContext called with wrong state: %v", status)
+	}
+	if err := su.dial(ctx, serverAddr); err != nil {
+		return err
+	}
+	return su.waitUntilReadyContext(ctx)
+}
+
+// Re-establish the association with the server passed to Connect or
+// ConnectContext, after the previous association has ended. It fails if
+// operations are still running on the old association.
+func (su *ServiceUser) reconnect(ctx context.Context) error {
+	su.mu.Lock()
+	serverAddr, done := su.serverAddr, su.done
+	su.mu.Unlock()
+	if serverAddr == "" {
+		return errors.New("dicom.serviceUser: cannot reconnect an association set up with SetConn")
+	}
+	// Wait for the old state machine to finish, so that it doesn't consume
+	// the events for the new one.
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	su.mu.Lock()
+	if su.status != serviceUserClosed || su.done != done {
+		// Another operation has reconnected already.
+		su.mu.Unlock()
+		return su.waitUntilReadyContext(ctx)
+	}
+	if su.numInFlight > 0 {
+		su.mu.Unlock()
+		return fmt.Errorf("dicom.serviceUser: cannot reconnect with %d operations running", su.numInFlight)
+	}
+	// Drop the events left for the old state machine, e.g., an A-ABORT
+	// request sent after it finished.
+	for drained := false; !drained; {
+		select {
+		case <-su.disp.downcallCh:
+		default:
+			drained = true
+		}
+	}
+	su.disp.dropClosedCommands()
+	dicomlog.Vprintf(0, "dicom.serviceUser(%s): Reconnecting to %s after: %v", su.label, serverAddr, su.err)
+	su.status = serviceUserInitial
+	su.err = nil
+	su.opsWindow = nil
+	su.start()
+	su.mu.Unlock()
+	if err := su.dial(ctx, serverAddr); err != nil {
+		return err
+	}
+	return su.waitUntilReadyContext(ctx)
+}
+
+func (su *ServiceUser) getStatus() serviceUserStatus {
+	su.mu.Lock()
+	defer su.mu.Unlock()
+	return su.status
+}
+
+// Open the connection to the server using ServiceUserParams.Dialer, and hand
+// it to the statemachine.
+func (su *ServiceUser) dial(ctx context.Context, serverAddr string) error {
+	su.mu.Lock()
+	su.serverAddr = serverAddr
+	su.mu.Unlock()
+	dialCtx := ctx
+	if timeout := su.params.ConnectTimeout; timeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	dialer := su.params.Dialer
+	if dialer == nil {
+		dialer = (&net.Dialer{}).DialContext
+	}
+	conn, err := dialer(dialCtx, "tcp", serverAddr)
+	if err == nil && su.params.TLSConfig != nil {
+		conn, err = tlsHandshake(dialCtx, conn, su.params.TLSConfig, serverAddr)
 	}
-	conn, err := net.Dial("tcp", serverAddr)
 	if err != nil {
 		dicomlog.Vprintf(0, "dicom.serviceUser: Connect(%s): %v", serverAddr, err)
+		if ctx.Err() == nil && dialCtx.Err() == context.DeadlineExceeded {
+			err = &TimeoutError{Op: "connect", Duration: su.params.ConnectTimeout}
+		}
+		su.setError(err)
 		su.disp.downcallCh <- stateEvent{event: evt17, pdu: nil, err: err}
-	} else {
-		su.disp.downcallCh <- stateEvent{event: evt02, pdu: nil, err: nil, conn: conn}
+		return err
+	}
+	su.disp.downcallCh <- stateEvent{event: evt02, pdu: nil, err: nil, conn: conn}
+	return nil
+}
+
+// Run the TLS client handshake on "conn". Closes "conn" on error.
+func tlsHandshake(ctx context.Context, conn net.Conn, config *tls.Config, serverAddr string) (net.Conn, error) {
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(serverAddr)
+		if err != nil {
+			host = serverAddr
+		}
+		config = config.Clone()
+		config.ServerName = host
 	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
 }
 
 // SetConn instructs ServiceUser to use the given network connection to talk to
 // the server. Either Connect or SetConn must be before calling CStore, etc.
 func (su *ServiceUser) SetConn(conn net.Conn) {
-	doassert(su.status == serviceUserInitial)
+	doassert(su.getStatus() == serviceUserInitial)
 	su.disp.downcallCh <- stateEvent{event: evt02, pdu: nil, err: nil, conn: conn}
 }
 
 // CEcho send a C-ECHO request to the remote AE and waits for a
 // response. Returns nil iff the remote AE responds ok.
 func (su *ServiceUser) CEcho() error {
+	return su.CEchoContext(context.Background())
+}
+
+// CEchoContext is like CEcho, but gives up when ctx is done. Since C-ECHO
+// cannot be cancelled, the association is then aborted and ctx.Err() is
+// returned. The request is not sent if ctx is already done.
+func (su *ServiceUser) CEchoContext(ctx context.Context) error {
 	err := su.waitUntilReady()
 	if err != nil {
 		return err
 	}
-	context, err := su.cm.lookupByAbstractSyntaxUID(dicomuid.VerificationSOPClass)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	entry, err := su.cm.lookupByAbstractSyntaxUID(dicomuid.VerificationSOPClass)
 	if err != nil {
 		return err
 	}
-	cs, err := su.disp.newCommand(su.cm, context)
+	defer su.releaseOp(su.acquireOp())
+	cs, err := su.disp.newCommand(su.cm, entry)
 	if err != nil {
 		return err
 	}
@@ -202,51 +655,173 @@ func (su *ServiceUser) CEcho() error {
 		&dimse.CEchoRq{MessageID: cs.messageID,
 			CommandDataSetType: dimse.CommandDataSetTypeNull,
 		}, nil)
-	event, ok := <-cs.upcallCh
-	if !ok {
-		return fmt.Errorf("Failed to receive C-ECHO response")
+	event, err := su.readResponse(ctx, cs, "C-ECHO response", false)
+	if err != nil {
+		return err
 	}
 	resp, ok := event.command.(*dimse.CEchoRsp)
 	if !ok {
-		return fmt.Errorf("Invalid response for C-ECHO: %v", event.command)
+		return &ProtocolError{Err: fmt.Errorf("found wrong response for C-ECHO: %v", event.command)}
 	}
 	if resp.Status.Status != dimse.StatusSuccess {
-		err = fmt.Errorf("Non-OK status in C-ECHO response: %+v", resp.Status)
+		return &StatusError{Op: "C-ECHO", Status: resp.Status}
 	}
-	return err
+	return nil
+}
+
+// UserIdentityResponse returns the server's response to
+// ServiceUserParams.UserIdentity, e.g., a Kerberos server ticket. It returns
+// nil if the server didn't send a response. It blocks until the association is
+// established.
+func (su *ServiceUser) UserIdentityResponse() ([]byte, error) {
+	if err := su.waitUntilReady(); err != nil {
+		return nil, err
+	}
+	if su.cm.userIdentityResponse == nil {
+		return nil, nil
+	}
+	return su.cm.userIdentityResponse.ServerResponse, nil
+}
+
+// ExtendedNegotiation returns the service-class application information that
+// the server accepted for sopClassUID through SOP class extended negotiation.
+// It returns nil if the server didn't answer the proposal, i.e., none of the
+// proposed features is supported. It blocks until the association is
+// established.
+func (su *ServiceUser) ExtendedNegotiation(sopClassUID string) ([]byte, error) {
+	if err := su.waitUntilReady(); err != nil {
+		return nil, err
+	}
+	return su.cm.extendedNegotiation[sopClassUID], nil
 }
 
 // CStore issues a C-STORE request to transfer "ds" in remove peer.  It blocks
-// until the operation finishes.
+// until the operation finishes. The data is sent in its own transfer syntax
+// if the server accepted it, and is converted to another accepted transfer
+// syntax otherwise; see ServiceUserParams.TransferSyntaxes. It fails if no
+// accepted transfer syntax can hold the data.
 //
 // REQUIRES: Connect() or SetConn has been called.
 func (su *ServiceUser) CStore(ds *dicom.DataSet) error {
-	err := su.waitUntilReady()
-	if err != nil {
-		return err
-	}
-	doassert(su.cm != nil)
+	return su.CStoreContext(context.Background(), ds)
+}
+
+// CStoreContext is like CStore, but gives up when ctx is done. Since C-STORE
+// cannot be cancelled, the association is then aborted and ctx.Err() is
+// returned. The request is not sent if ctx is already done.
+//
+// Failed attempts are retried as ServiceUserParams.RetryPolicy directs. If
+// the association was lost, it is re-established first, provided it was set
+// up with Connect or ConnectContext.
+func (su *ServiceUser) CStoreContext(ctx context.Context, ds *dicom.DataSet) error {
+	return su.retryCStore(ctx, func() error { return su.cStore(ctx, ds) })
+}
+
+// CStoreFile issues a C-STORE request to transfer the DICOM file at "path". The
+// file is read as it is sent, so memory use stays near one PDU regardless of
+// the file size. The SOP class, SOP instance and transfer syntax are taken
+// from the file's group-0002 meta header, which is not sent. The data is sent
+// as is, so the server must have accepted the SOP class in the file's transfer
+// syntax. It blocks until the operation finishes.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CStoreFile(path string) error {
+	return su.CStoreFileContext(context.Background(), path)
+}
+
+// CStoreFileContext is like CStoreFile, but gives up when ctx is done, as
+// CStoreContext does. Failed attempts are retried as
+// ServiceUserParams.RetryPolicy directs.
+func (su *ServiceUser) CStoreFileContext(ctx context.Context, path string) error {
+	return su.retryCStore(ctx, func() error {
+		f, header, err := openDICOMFile(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return su.cStoreStream(ctx, header.sopClassUID, header.sopInstanceUID, header.transferSyntaxUID, f, header.dataSize)
+	})
+}
+
+// CStoreStream issues a C-STORE request to transfer "size" bytes read from
+// "r". The data must be a data set encoded in "transferSyntaxUID", without the
+// group-0002 meta header, e.g., a DICOM file past its meta header. It is read
+// as it is sent, and sent as is, so the server must have accepted sopClassUID
+// in transferSyntaxUID. It blocks until the operation finishes.
+//
+// Since the data cannot be read again, CStoreStream is not retried.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CStoreStream(sopClassUID, sopInstanceUID, transferSyntaxUID string, r io.Reader, size int64) error {
+	return su.CStoreStreamContext(context.Background(), sopClassUID, sopInstanceUID, transferSyntaxUID, r, size)
+}
+
+// CStoreStreamContext is like CStoreStream, but gives up when ctx is done, as
+// CStoreContext does. The transfer stops at the next read from "r".
+func (su *ServiceUser) CStoreStreamContext(ctx context.Context, sopClassUID, sopInstanceUID, transferSyntaxUID string, r io.Reader, size int64) error {
+	return su.cStoreStream(ctx, sopClassUID, sopInstanceUID, transferSyntaxUID, r, size)
+}
 
+// Run "op", a C-STORE attempt, as ServiceUserParams.RetryPolicy directs. If
+// the association was lost, it is re-established before retrying.
+func (su *ServiceUser) retryCStore(ctx context.Context, op func() error) error {
+	return su.params.RetryPolicy.run(ctx, su.label, func(attempt int) error {
+		if attempt > 1 && su.getStatus() == serviceUserClosed {
+			if err := su.reconnect(ctx); err != nil {
+				return err
+			}
+		}
+		return op()
+	})
+}
+
+// Run one C-STORE attempt.
+func (su *ServiceUser) cStore(ctx context.Context, ds *dicom.DataSet) error {
 	var sopClassUID string
 	if sopClassUIDElem, err := ds.FindElementByTag(dicomtag.MediaStorageSOPClassUID); err != nil {
 		return err
 	} else if sopClassUID, err = sopClassUIDElem.GetString(); err != nil {
 		return err
 	}
-	context, err := su.cm.lookupByAbstractSyntaxUID(sopClassUID)
+	return su.runCStore(ctx, sopClassUID, func(cs *serviceCommandState) error {
+		return runCStoreOnAssociation(ctx, cs.upcallCh, su.disp.downcallCh, su.cm, cs.messageID, ds, su.params.DIMSETimeout)
+	})
+}
+
+// Run one C-STORE attempt with data read from "r".
+func (su *ServiceUser) cStoreStream(ctx context.Context, sopClassUID, sopInstanceUID, transferSyntaxUID string, r io.Reader, size int64) error {
+	return su.runCStore(ctx, sopClassUID, func(cs *serviceCommandState) error {
+		return runCStoreStreamOnAssociation(ctx, cs.upcallCh, su.disp.downcallCh, su.cm, cs.messageID,
+			sopClassUID, sopInstanceUID, transferSyntaxUID, r, size, su.params.DIMSETimeout)
+	})
+}
+
+// Allocate a command for a C-STORE of sopClassUID, and run "op" on it.
+func (su *ServiceUser) runCStore(ctx context.Context, sopClassUID string, op func(cs *serviceCommandState) error) error {
+	err := su.waitUntilReady()
 	if err != nil {
 		return err
 	}
-	cs, err := su.disp.newCommand(su.cm, context)
-	if err != nil {
+	if err := ctx.Err(); err != nil {
 		return err
 	}
+	doassert(su.cm != nil)
+
+	entry, err := su.cm.lookupByAbstractSyntaxUID(sopClassUID)
 	if err != nil {
 		dicomlog.Vprintf(0, "dicom.serviceUser: C-STORE: sop class %v not found in context %v", sopClassUID, err)
 		return err
 	}
+	defer su.releaseOp(su.acquireOp())
+	cs, err := su.disp.newCommand(su.cm, entry)
+	if err != nil {
+		return err
+	}
 	defer su.disp.deleteCommand(cs)
-	return runCStoreOnAssociation(cs.upcallCh, su.disp.downcallCh, su.cm, cs.messageID, ds)
+	if err := op(cs); err != nil {
+		return su.handleAssociationError(err)
+	}
+	return nil
 }
 
 // QRLevel is used to specify the element hierarchy assumed during C-FIND,
@@ -336,18 +911,28 @@ func encodeQRPayload(opType qrOpType, qrLevel QRLevel, filter []*dicom.Element,
 	if err := dataEncoder.Error(); err != nil {
 		return context, nil, err
 	}
-	return context, dataEncoder.Bytes(), err
+	payload, err := deflateIfNeeded(dataEncoder.Bytes(), context.transferSyntaxUID)
+	return context, payload, err
 }
 
 // CFind issues a C-FIND request. Returns a channel that streams sequence of
-// either an error or a dataset found. The caller MUST read all responses from
-// the channel before issuing any other DIMSE command (C-FIND, C-STORE, etc).
+// either an error or a dataset found. The caller must read all responses from
+// the channel; an unread channel holds a slot in the asynchronous operations
+// window.
 //
 // The param sopClassUID is one of the UIDs defined in sopclass.QRFindClasses.
 // filter is the list of elements to match and retrieve.
 //
 // REQUIRES: Connect() or SetConn has been called.
 func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFindResult {
+	return su.CFindContext(context.Background(), qrLevel, filter)
+}
+
+// CFindContext is like CFind, but cancels the request with C-CANCEL-RQ when ctx
+// is done. The channel then ends with a CFindResult whose Err is ctx.Err(),
+// unless the server finishes the query first. The request is not sent if ctx
+// is already done.
+func (su *ServiceUser) CFindContext(ctx context.Context, qrLevel QRLevel, filter []*dicom.Element) chan CFindResult {
 	ch := make(chan CFindResult, 128)
 	err := su.waitUntilReady()
 	if err != nil {
@@ -355,13 +940,12 @@ func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFin
 		close(ch)
 		return ch
 	}
-	context, payload, err := encodeQRPayload(qrOpCFind, qrLevel, filter, su.cm)
-	if err != nil {
+	if err := ctx.Err(); err != nil {
 		ch <- CFindResult{Err: err}
 		close(ch)
 		return ch
 	}
-	cs, err := su.disp.newCommand(su.cm, context)
+	context, payload, err := encodeQRPayload(qrOpCFind, qrLevel, filter, su.cm)
 	if err != nil {
 		ch <- CFindResult{Err: err}
 		close(ch)
@@ -369,6 +953,12 @@ func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFin
 	}
 	go func() {
 		defer close(ch)
+		defer su.releaseOp(su.acquireOp())
+		cs, err := su.disp.newCommand(su.cm, context)
+		if err != nil {
+			ch <- CFindResult{Err: err}
+			return
+		}
 		defer su.disp.deleteCommand(cs)
 		cs.sendMessage(
 			&dimse.CFindRq{
@@ -378,17 +968,28 @@ func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFin
 			},
 			payload)
 		for {
-			event, ok := <-cs.upcallCh
-			if !ok {
-				su.status = serviceUserClosed
-				ch <- CFindResult{Err: fmt.Errorf("Connection closed while waiting for C-FIND response")}
+			event, err := su.readResponse(ctx, cs, "C-FIND response", true)
+			if err != nil {
+				ch <- CFindResult{Err: err}
 				break
 			}
 			doassert(event.eventType == upcallEventData)
 			doassert(event.command != nil)
 			resp, ok := event.command.(*dimse.CFindRsp)
 			if !ok {
-				ch <- CFindResult{Err: fmt.Errorf("Found wrong response for C-FIND: %v", event.command)}
+				ch <- CFindResult{Err: &ProtocolError{Err: fmt.Errorf("found wrong response for C-FIND: %v", event.command)}}
+				break
+			}
+			if status := resp.Status.Status; status != dimse.StatusPending && !isSuccessOrWarning(status) {
+				if event.data != nil {
+					_ = event.data.Ack()
+				}
+				if status == dimse.StatusCancel {
+					ch <- CFindResult{Err: cancelledError(ctx, cs, "C-FIND")}
+				} else {
+					dicomlog.Vprintf(0, "dicom.serviceUser: C-FIND: failed: %v", resp.String())
+					ch <- CFindResult{Err: &StatusError{Op: "C-FIND", Status: resp.Status}}
+				}
 				break
 			}
 			var payload []byte
@@ -406,10 +1007,6 @@ func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFin
 				_ = event.data.Ack()
 			}
 			if resp.Status.Status != dimse.StatusPending {
-				if resp.Status.Status != 0 {
-					// TODO: report error if status!= 0
-					panic(resp)
-				}
 				break
 			}
 		}
@@ -417,25 +1014,195 @@ func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFin
 	return ch
 }
 
+// CMoveProgress is an object streamed by CMove method. The server sends one for
+// each sub-operation, and a final one when the C-MOVE finishes.
+type CMoveProgress struct {
+	// Err is set in the final progress if the C-MOVE failed, either because
+	// the server reported an error status or because of a communication
+	// error.
+	Err error
+
+	// Status reported by the server. It is dimse.StatusPending until the
+	// final progress. A warning status in the final progress, e.g.,
+	// dimse.CMoveSubOperationsCompleteWithFailures, means that some
+	// sub-operations failed.
+	Status dimse.Status
+
+	// Number of sub-operations, i.e., C-STOREs to the destination AE, in each
+	// state. Remaining may be zero if the server doesn't report it.
+	Remaining int
+	Completed int
+	Failed    int
+	Warning   int
+
+	// Final is true for the last progress of the C-MOVE.
+	Final bool
+
+	// FailedSOPInstanceUIDs lists the instances that couldn't be moved, as
+	// reported by the server in the final progress.
+	FailedSOPInstanceUIDs []string
+}
+
+// CMove issues a C-MOVE request, which asks the server to send the datasets
+// matching "filter" to "destinationAE" using C-STORE. The server must know the
+// address of destinationAE. Returns a channel that streams the progress of the
+// sub-operations, ending with a progress whose Final field is true. The
+// caller must read all the values from the channel.
+//
+// When ctx is done, the request is cancelled with C-CANCEL-RQ, and the final
+// progress has status dimse.StatusCancel and Err set to ctx.Err(), unless the
+// server finishes the C-MOVE first. The request is not sent if ctx is already
+// done.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CMove(ctx context.Context, qrLevel QRLevel, filter []*dicom.Element, destinationAE string) chan CMoveProgress {
+	ch := make(chan CMoveProgress, 128)
+	fail := func(err error) chan CMoveProgress {
+		ch <- CMoveProgress{Err: err, Final: true}
+		close(ch)
+		return ch
+	}
+	if err := su.waitUntilReady(); err != nil {
+		return fail(err)
+	}
+	if err := ctx.Err(); err != nil {
+		return fail(err)
+	}
+	context, payload, err := encodeQRPayload(qrOpCMove, qrLevel, filter, su.cm)
+	if err != nil {
+		return fail(err)
+	}
+	go func() {
+		defer close(ch)
+		defer su.releaseOp(su.acquireOp())
+		cs, err := su.disp.newCommand(su.cm, context)
+		if err != nil {
+			ch <- CMoveProgress{Err: err, Final: true}
+			return
+		}
+		defer su.disp.deleteCommand(cs)
+		cs.sendMessage(
+			&dimse.CMoveRq{
+				AffectedSOPClassUID: context.abstractSyntaxUID,
+				MessageID:           cs.messageID,
+				MoveDestination:     destinationAE,
+				CommandDataSetType:  dimse.CommandDataSetTypeNonNull,
+			},
+			payload)
+		for {
+			event, err := su.readResponse(ctx, cs, "C-MOVE response", true)
+			if err != nil {
+				ch <- CMoveProgress{Err: err, Final: true}
+				return
+			}
+			resp, ok := event.command.(*dimse.CMoveRsp)
+			if !ok {
+				ch <- CMoveProgress{Err: &ProtocolError{Err: fmt.Errorf("found wrong response for C-MOVE: %v", event.command)}, Final: true}
+				return
+			}
+			progress := CMoveProgress{
+				Status:    resp.Status,
+				Remaining: int(resp.NumberOfRemainingSuboperations),
+				Completed: int(resp.NumberOfCompletedSuboperations),
+				Failed:    int(resp.NumberOfFailedSuboperations),
+				Warning:   int(resp.NumberOfWarningSuboperations),
+			}
+			if event.data != nil {
+				payload, err := io.ReadAll(event.data)
+				_ = event.data.Ack()
+				if err == nil {
+					progress.FailedSOPInstanceUIDs = readFailedSOPInstanceUIDList(payload, context.transferSyntaxUID)
+				}
+			}
+			if resp.Status.Status == dimse.StatusPending {
+				ch <- progress
+				continue
+			}
+			progress.Final = true
+			if resp.Status.Status == dimse.StatusCancel {
+				progress.Err = cancelledError(ctx, cs, "C-MOVE")
+			} else if !isSuccessOrWarning(resp.Status.Status) {
+				progress.Err = &StatusError{Op: "C-MOVE", Status: resp.Status}
+				dicomlog.Vprintf(0, "dicom.serviceUser: C-MOVE: %v", progress.Err)
+			}
+			ch <- progress
+			return
+		}
+	}()
+	return ch
+}
+
+// Report whether "status" is success or one of the warnings of P3.7 C.
+func isSuccessOrWarning(status dimse.StatusCode) bool {
+	return status == dimse.StatusSuccess ||
+		status == dimse.StatusAttributeListError ||
+		status == dimse.StatusAttributeValueOutOfRange ||
+		(status >= 0xb000 && status <= 0xbfff)
+}
+
+// Extract the Failed SOP Instance UID List from the identifier of a C-MOVE or
+// C-GET response. Returns nil if the list is absent or cannot be decoded.
+func readFailedSOPInstanceUIDList(payload []byte, transferSyntaxUID string) []string {
+	elems, err := readElementsInBytes(payload, transferSyntaxUID)
+	if err != nil {
+		dicomlog.Vprintf(0, "dicom.serviceUser: Failed to decode the response identifier: %v", err)
+		return nil
+	}
+	for _, elem := range elems {
+		if elem.Tag != dicomtag.FailedSOPInstanceUIDList {
+			continue
+		}
+		var uids []string
+		for _, value := range elem.Value {
+			if uid, ok := value.(string); ok {
+				uids = append(uids, uid)
+			}
+		}
+		return uids
+	}
+	return nil
+}
+
 // CGet runs a C-GET command. It calls "cb" sequentially for every dataset
 // received. "cb" should return dimse.Success iff the data was successfully and
 // stably written. This function blocks until it receives all datasets from the
 // server.
 //
 // The "data" arg to "cb" is the serialized dataset, encoded according to
-// transferSyntaxUID.
+// transferSyntaxUID. Data received in DeflatedExplicitVRLittleEndian is
+// inflated first, and passed as ExplicitVRLittleEndian.
+//
+// The datasets arrive as C-STORE sub-operations on this association, so
+// ServiceUserParams.SOPClasses must list their storage classes in addition to
+// a C-GET class. The ServiceUser then proposes the SCP role for those storage
+// classes during the handshake; a strict server refuses to send datasets of
+// other classes.
 //
 // TODO(saito) We should parse the data into DataSet before passing to "cb".
 func (su *ServiceUser) CGet(qrLevel QRLevel, filter []*dicom.Element,
+	cb func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status) error {
+	return su.CGetContext(context.Background(), qrLevel, filter, cb)
+}
+
+// CGetContext is like CGet, but cancels the request with C-CANCEL-RQ when ctx
+// is done, and then returns ctx.Err() unless the server finishes the C-GET
+// first. The request is not sent if ctx is already done.
+func (su *ServiceUser) CGetContext(ctx context.Context, qrLevel QRLevel, filter []*dicom.Element,
 	cb func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status) error {
 	err := su.waitUntilReady()
 	if err != nil {
 		return err
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	context, payload, err := encodeQRPayload(qrOpCGet, qrLevel, filter, su.cm)
 	if err != nil {
 		return err
 	}
+	su.cgetMu.Lock()
+	defer su.cgetMu.Unlock()
+	defer su.releaseOp(su.acquireOp())
 	cs, err := su.disp.newCommand(su.cm, context)
 	if err != nil {
 		return err
@@ -444,19 +1211,7 @@ func (su *ServiceUser) CGet(qrLevel QRLevel, filter []*dicom.Element,
 
 	handleCStore := func(msg dimse.Message, data *dimse.DimseCommand, cs *serviceCommandState) {
 		c := msg.(*dimse.CStoreRq)
-		var payload []byte
-		if data != nil {
-			var _err error
-			payload, _err = io.ReadAll(data)
-			if _err != nil {
-				payload = nil
-			}
-		}
-		status := cb(
-			context.transferSyntaxUID,
-			c.AffectedSOPClassUID,
-			c.AffectedSOPInstanceUID,
-			payload)
+		status := runCGetCStoreCallback(cb, c, data, cs.context.transferSyntaxUID)
 		resp := &dimse.CStoreRsp{
 			AffectedSOPClassUID:       c.AffectedSOPClassUID,
 			MessageIDBeingRespondedTo: c.MessageID,
@@ -480,22 +1235,23 @@ func (su *ServiceUser) CGet(qrLevel QRLevel, filter []*dicom.Element,
 		},
 		payload)
 	for {
-		event, ok := <-cs.upcallCh
-		if !ok {
-			su.status = serviceUserClosed
-			return fmt.Errorf("Connection closed while waiting for C-GET response")
+		event, err := su.readResponse(ctx, cs, "C-GET response", true)
+		if err != nil {
+			return err
 		}
 		doassert(event.eventType == upcallEventData)
 		doassert(event.command != nil)
 		resp, ok := event.command.(*dimse.CGetRsp)
 		if !ok {
-			return fmt.Errorf("Found wrong response for C-GET: %v", event.command)
+			return &ProtocolError{Err: fmt.Errorf("found wrong response for C-GET: %v", event.command)}
+		}
+		if resp.Status.Status == dimse.StatusCancel {
+			return cancelledError(ctx, cs, "C-GET")
 		}
 		if resp.Status.Status != dimse.StatusPending {
 			if resp.Status.Status != 0 {
-				e := fmt.Errorf("Received C-GET error: %+v", resp)
-				dicomlog.Vprintf(0, "dicom.serviceUser: C-GET: %v", e)
-				return e
+				dicomlog.Vprintf(0, "dicom.serviceUser: C-GET: failed: %v", resp.String())
+				return &StatusError{Op: "C-GET", Status: resp.Status}
 			}
 			break
 		}
@@ -503,6 +1259,28 @@ func (su *ServiceUser) CGet(qrLevel QRLevel, filter []*dicom.Element,
 	return nil
 }
 
+// Hand the data of a C-STORE sub-operation of C-GET, received in
+// transferSyntaxUID, to "cb", and return the status to answer with. Deflated
+// data is inflated first, and handed over as ExplicitVRLittleEndian. Data that
+// cannot be read or inflated is refused without calling cb.
+func runCGetCStoreCallback(cb func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status,
+	c *dimse.CStoreRq, data *dimse.DimseCommand, transferSyntaxUID string) dimse.Status {
+	var payload []byte
+	if data != nil {
+		var err error
+		if payload, err = io.ReadAll(data); err != nil {
+			dicomlog.Vprintf(0, "dicom.serviceUser: C-GET: failed to read C-STORE data: %v", err)
+			return dimse.Status{Status: dimse.CStoreCannotUnderstand, ErrorComment: err.Error()}
+		}
+	}
+	payload, err := inflateIfNeeded(payload, transferSyntaxUID)
+	if err != nil {
+		dicomlog.Vprintf(0, "dicom.serviceUser: C-GET: %v", err)
+		return dimse.Status{Status: dimse.CStoreCannotUnderstand, ErrorComment: err.Error()}
+	}
+	return cb(inflatedTransferSyntax(transferSyntaxUID), c.AffectedSOPClassUID, c.AffectedSOPInstanceUID, payload)
+}
+
 // Release shuts down the connection. It must be called exactly once.  After
 // Release(), no other operation can be performed on the ServiceUser object.
 func (su *ServiceUser) Release() {
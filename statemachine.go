@@ -15,7 +15,6 @@ import (
 	"github.com/algm/go-netdicom/pdu"
 	"github.com/algm/go-netdicom/pdu/pdu_item"
 	"github.com/grailbio/go-dicom/dicomlog"
-	"github.com/grailbio/go-dicom/dicomuid"
 )
 
 type stateType int
@@ -136,10 +135,10 @@ var actionAe2 = &stateAction{"AE-2", "Connection established on the user side. S
 	func(sm *stateMachine, event stateEvent) stateType {
 		doassert(event.conn != nil)
 		sm.conn = event.conn
-		go networkReaderThread(sm.netCh, event.conn, DefaultMaxPDUSize, sm.label)
-		items := sm.contextManager.generateAssociateRequest(
-			sm.userParams.SOPClasses,
-			sm.userParams.TransferSyntaxes)
+		go networkReaderThread(sm.netCh, event.conn, sm.receivePDULimit(), sm.label)
+		sm.contextManager.callingAETitle = sm.userParams.CallingAETitle
+		sm.contextManager.calledAETitle = sm.userParams.CalledAETitle
+		items := sm.contextManager.generateAssociateRequest(&sm.userParams)
 		pdu := &pdu.AAssociateRQ{
 			ProtocolVersion: pdu.CurrentProtocolVersion,
 			CalledAETitle:   sm.userParams.CalledAETitle,
@@ -164,11 +163,14 @@ var actionAe3 = &stateAction{"AE-3", "Issue A-ASSOCIATE confirmation (accept) pr
 			return sta06
 		}
 		dicomlog.Vprintf(0, "dicom.stateMachine: AE-3: %v", err)
+		sm.reportError(&ProtocolError{Err: fmt.Errorf("invalid A-ASSOCIATE-AC: %w", err)})
 		return actionAa8.Callback(sm, event)
 	}}
 
 var actionAe4 = &stateAction{"AE-4", "Issue A-ASSOCIATE confirmation (reject) primitive and close transport connection",
 	func(sm *stateMachine, event stateEvent) stateType {
+		v := event.pdu.(*pdu.AAssociateRj)
+		sm.reportError(&AssociationRejectedError{Result: v.Result, Source: v.Source, Reason: v.Reason})
 		sm.closeConnection()
 		return sta01
 	}}
@@ -178,7 +180,7 @@ var actionAe5 = &stateAction{"AE-5", "Issue Transport connection response primit
 		doassert(event.conn != nil)
 		sm.startTimer()
 		go func(ch chan stateEvent, conn net.Conn) {
-			networkReaderThread(ch, conn, DefaultMaxPDUSize, sm.label)
+			networkReaderThread(ch, conn, sm.receivePDULimit(), sm.label)
 		}(sm.netCh, event.conn)
 		return sta02
 	}}
@@ -201,26 +203,44 @@ otherwise issue A-ASSOCIATE-RJ-PDU and start ARTIM timer`,
 		v := event.pdu.(*pdu.AAssociateRQ)
 		if v.ProtocolVersion != 0x0001 {
 			dicomlog.Vprintf(0, "dicom.stateMachine(%s): Wrong remote protocol version 0x%x", sm.label, v.ProtocolVersion)
-			rj := pdu.AAssociateRj{Result: 1, Source: 2, Reason: 2}
+			// Reason 2 is "protocol-version-not-supported" for the ACSE source.
+			rj := pdu.AAssociateRj{
+				Result: pdu.ResultRejectedPermanent,
+				Source: pdu.SourceULServiceProviderACSE,
+				Reason: 2,
+			}
 			sendPDU(sm, &rj)
 			sm.startTimer()
 			return sta13
 		}
-		responses, err := sm.contextManager.onAssociateRequest(v.Items)
+		sm.contextManager.callingAETitle = strings.TrimSpace(v.CallingAETitle)
+		sm.contextManager.calledAETitle = strings.TrimSpace(v.CalledAETitle)
+		if rj := checkAETitles(sm.contextManager); rj != nil {
+			dicomlog.Vprintf(0, "dicom.stateMachine(%s): Rejecting association with an empty AE title: %v", sm.label, rj)
+			sm.downcallCh <- stateEvent{event: evt08, pdu: rj}
+			return sta03
+		}
+		if rj := checkAssociationRequest(sm, v); rj != nil {
+			dicomlog.Vprintf(0, "dicom.stateMachine(%s): Rejecting association from %s to %s: %v",
+				sm.label, v.CallingAETitle, v.CalledAETitle, rj)
+			sm.downcallCh <- stateEvent{event: evt08, pdu: rj}
+			return sta03
+		}
+		responses, err := sm.contextManager.onAssociateRequest(&sm.providerParams, v.Items)
+		if err == nil && !hasPresentationContext(responses) {
+			err = fmt.Errorf("no presentation context proposed")
+		}
 		if err != nil {
-			// TODO(saito) set proper error code.
+			dicomlog.Vprintf(0, "dicom.stateMachine(%s): Invalid A-ASSOCIATE-RQ: %v", sm.label, err)
 			sm.downcallCh <- stateEvent{
 				event: evt08,
 				pdu: &pdu.AAssociateRj{
 					Result: pdu.ResultRejectedPermanent,
 					Source: pdu.SourceULServiceProviderACSE,
-					Reason: 1,
+					Reason: pdu.RejectReasonNone,
 				},
 			}
 		} else {
-			doassert(len(responses) > 0)
-			doassert(v.CalledAETitle != "")
-			doassert(v.CallingAETitle != "")
 			sm.downcallCh <- stateEvent{
 				event: evt07,
 				pdu: &pdu.AAssociateAC{
@@ -233,6 +253,97 @@ otherwise issue A-ASSOCIATE-RJ-PDU and start ARTIM timer`,
 		}
 		return sta03
 	}}
+
+// Report whether "items" include a presentation context item.
+func hasPresentationContext(items []pdu_item.SubItem) bool {
+	for _, item := range items {
+		if _, ok := item.(*pdu_item.PresentationContextItem); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAETitles rejects an A-ASSOCIATE-RQ whose AE titles are blank. P3.8
+// 9.3.2 requires both.
+func checkAETitles(cm *contextManager) *pdu.AAssociateRj {
+	reject := func(reason pdu.RejectReasonType) *pdu.AAssociateRj {
+		return &pdu.AAssociateRj{
+			Result: pdu.ResultRejectedPermanent,
+			Source: pdu.SourceULServiceUser,
+			Reason: reason,
+		}
+	}
+	if cm.callingAETitle == "" {
+		return reject(pdu.RejectReasonCallingAETitleNotRecognized)
+	}
+	if cm.calledAETitle == "" {
+		return reject(pdu.RejectReasonCalledAETitleNotRecognized)
+	}
+	return nil
+}
+
+// checkAssociationRequest runs the provider's OnAssociationRequest and
+// AuthenticateUser callbacks, if any. It returns nil if the association should
+// proceed.
+func checkAssociationRequest(sm *stateMachine, v *pdu.AAssociateRQ) *pdu.AAssociateRj {
+	params := &sm.providerParams
+	if params.OnAssociationRequest == nil && params.AuthenticateUser == nil {
+		return nil
+	}
+	// AE titles are space-padded on the wire. The padding is insignificant.
+	req := AssociationRequest{
+		CallingAETitle:       strings.TrimSpace(v.CallingAETitle),
+		CalledAETitle:        strings.TrimSpace(v.CalledAETitle),
+		PresentationContexts: extractPresentationContextItems(v.Items),
+	}
+	if sm.conn != nil {
+		req.RemoteAddr = sm.conn.RemoteAddr()
+	}
+	for _, item := range v.Items {
+		if ui, ok := item.(*pdu_item.UserInformationItem); ok {
+			req.UserInformation = append(req.UserInformation, ui.Items...)
+		}
+	}
+	if params.OnAssociationRequest != nil {
+		if rj := params.OnAssociationRequest(req); rj != nil {
+			return fillAssociateRjDefaults(rj)
+		}
+	}
+	if params.AuthenticateUser != nil {
+		var identity *pdu_item.UserIdentitySubItem
+		for _, item := range req.UserInformation {
+			if c, ok := item.(*pdu_item.UserIdentitySubItem); ok {
+				identity = c
+			}
+		}
+		response, err := params.AuthenticateUser(req, identity)
+		if err != nil {
+			dicomlog.Vprintf(0, "dicom.stateMachine(%s): User authentication failed: %v", sm.label, err)
+			return &pdu.AAssociateRj{
+				Result: pdu.ResultRejectedPermanent,
+				Source: pdu.SourceULServiceUser,
+				Reason: pdu.RejectReasonNone,
+			}
+		}
+		if identity != nil && identity.PositiveResponseRequested {
+			sm.contextManager.userIdentityResponse = &pdu_item.UserIdentityResponseSubItem{ServerResponse: response}
+		}
+	}
+	return nil
+}
+
+func fillAssociateRjDefaults(rj *pdu.AAssociateRj) *pdu.AAssociateRj {
+	rj2 := *rj
+	if rj2.Result == 0 {
+		rj2.Result = pdu.ResultRejectedPermanent
+	}
+	if rj2.Source == 0 {
+		rj2.Source = pdu.SourceULServiceUser
+	}
+	return &rj2
+}
+
 var actionAe7 = &stateAction{"AE-7", "Send A-ASSOCIATE-AC PDU",
 	func(sm *stateMachine, event stateEvent) stateType {
 		sendPDU(sm, event.pdu.(*pdu.AAssociateAC))
@@ -250,23 +361,50 @@ var actionAe8 = &stateAction{"AE-8", "Send A-ASSOCIATE-RJ PDU and start ARTIM ti
 		return sta13
 	}}
 
-// Produce a list of P_DATA_TF PDUs that collective store "data".
-func splitDataIntoPDUs(sm *stateMachine, abstractSyntaxName string, command bool, data []byte) []pdu.PDataTf {
-	doassert(len(data) > 0)
-	context, err := sm.contextManager.lookupByAbstractSyntaxUID(abstractSyntaxName)
-	if err != nil {
-		// TODO(saito) Don't crash here.
-		panic(fmt.Sprintf("dicom.stateMachine(%s): Illegal syntax name %s: %s", sm.label, dicomuid.UIDString(abstractSyntaxName), err))
+// maxPDUSizeParams returns the MaxPDUSize and MaxSendPDUSize settings for this
+// side of the association.
+func (sm *stateMachine) maxPDUSizeParams() (maxPDUSize, maxSendPDUSize int) {
+	if sm.isUser {
+		return sm.userParams.MaxPDUSize, sm.userParams.MaxSendPDUSize
+	}
+	return sm.providerParams.MaxPDUSize, sm.providerParams.MaxSendPDUSize
+}
+
+// receivePDULimit returns the size limit passed to pdu.ReadPDU. Zero means no
+// limit.
+func (sm *stateMachine) receivePDULimit() int {
+	maxPDUSize, _ := sm.maxPDUSizeParams()
+	return int(advertisedPDUSize(maxPDUSize))
+}
+
+// sendPDUSize returns the size of the P_DATA_TF PDUs sent to the peer: the
+// size advertised by the peer, lowered to MaxSendPDUSize if set.
+func (sm *stateMachine) sendPDUSize() int {
+	_, maxSendPDUSize := sm.maxPDUSizeParams()
+	size := sm.contextManager.peerMaxPDUSize
+	if maxSendPDUSize > 0 && (size == 0 || size > maxSendPDUSize) {
+		size = maxSendPDUSize
 	}
+	if size == 0 {
+		// Both sides are unlimited. Pick something reasonable.
+		size = DefaultMaxPDUSize
+	}
+	return size
+}
+
+// Produce a list of P_DATA_TF PDUs that collective store "data". Empty data
+// produces one empty PDV.
+func splitDataIntoPDUs(sm *stateMachine, contextID byte, command bool, data []byte) ([]pdu.PDataTf, error) {
 	var pdus []pdu.PDataTf
 	// two byte header overhead.
 	//
 	// TODO(saito) move the magic number elsewhere.
-	var maxChunkSize = sm.contextManager.peerMaxPDUSize - 8
+	maxPDUSize := sm.sendPDUSize()
+	var maxChunkSize = maxPDUSize - 8
 	if maxChunkSize <= 0 {
-		panic(fmt.Sprintf("dicom.stateMachine(%s): Invalid max PDU size %d", sm.label, sm.contextManager.peerMaxPDUSize))
+		return nil, fmt.Errorf("dicom.stateMachine(%s): Invalid max PDU size %d", sm.label, maxPDUSize)
 	}
-	for len(data) > 0 {
+	for first := true; first || len(data) > 0; first = false {
 		chunkSize := len(data)
 		if chunkSize > maxChunkSize {
 			chunkSize = maxChunkSize
@@ -275,16 +413,177 @@ func splitDataIntoPDUs(sm *stateMachine, abstractSyntaxName string, command bool
 		data = data[chunkSize:]
 		pdus = append(pdus, pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
 			pdu.PresentationDataValueItem{
-				ContextID: context.contextID,
+				ContextID: contextID,
 				Command:   command,
 				Last:      false, // Set later.
 				Value:     chunk,
 			}}})
 	}
-	if len(pdus) > 0 {
-		pdus[len(pdus)-1].Items[0].Last = true
+	pdus[len(pdus)-1].Items[0].Last = true
+	return pdus, nil
+}
+
+// Encode the DIMSE message in "payload" into P-DATA-TF PDUs.
+func encodeDIMSEPayload(sm *stateMachine, payload *stateEventDIMSEPayload) ([]pdu.PDataTf, error) {
+	command := payload.command
+	e := bytes.Buffer{}
+	if err := dimse.EncodeMessage(&e, command); err != nil {
+		return nil, fmt.Errorf("failed to encode DIMSE message %v: %w", command, err)
+	}
+	pdus, err := splitDataIntoPDUs(sm, payload.contextID, true /*command*/, e.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if command.HasData() && payload.dataReader == nil {
+		dataPDUs, err := splitDataIntoPDUs(sm, payload.contextID, false /*data*/, payload.data)
+		if err != nil {
+			return nil, err
+		}
+		pdus = append(pdus, dataPDUs...)
+	} else if !command.HasData() && (len(payload.data) > 0 || payload.dataReader != nil) {
+		return nil, fmt.Errorf("found DIMSE data for a message without data: %v", command)
+	}
+	return pdus, nil
+}
+
+// Send the DIMSE message in "payload". If the data is read from
+// payload.dataReader, only the command is sent here. The data is then streamed
+// by startDIMSEStream, and payload.sent is closed once it has been sent.
+// Returns an error if the message could not be encoded, in which case the
+// association should be aborted. Failures to write to the connection are
+// handled by evt17.
+func sendDIMSEPayload(sm *stateMachine, payload *stateEventDIMSEPayload) error {
+	pdus, err := encodeDIMSEPayload(sm, payload)
+	if err != nil {
+		closeSent(payload)
+		return err
+	}
+	for _, pdu := range pdus {
+		if sendPDU(sm, &pdu) != nil {
+			closeSent(payload)
+			return nil
+		}
+	}
+	if payload.dataReader == nil {
+		closeSent(payload)
+		return nil
+	}
+	startDIMSEStream(sm, payload)
+	return nil
+}
+
+// Report that the state machine is done with "payload".
+func closeSent(payload *stateEventDIMSEPayload) {
+	if payload.sent != nil {
+		close(payload.sent)
+	}
+}
+
+// The data of a DIMSE message being streamed. Another goroutine reads the data
+// and hands it over one PDU's worth at a time, and the state machine sends
+// each chunk as an event. So a long transfer does not keep the state machine
+// from handling the events that arrive meanwhile, such as an A-ABORT or a
+// timeout.
+type dimseStream struct {
+	payload *stateEventDIMSEPayload
+	chunkCh chan dimseDataChunk
+	// Closed to stop the reader goroutine.
+	stop chan struct{}
+}
+
+// A chunk of data read for a dimseStream.
+type dimseDataChunk struct {
+	data []byte
+	last bool
+	// Set if the data could not be read. The stream ends.
+	err error
+}
+
+// Start streaming the data of "payload", whose command has been sent.
+func startDIMSEStream(sm *stateMachine, payload *stateEventDIMSEPayload) {
+	doassert(sm.stream == nil)
+	// Two byte header overhead, as in splitDataIntoPDUs.
+	chunkSize := int64(sm.sendPDUSize() - 8)
+	stream := &dimseStream{
+		payload: payload,
+		chunkCh: make(chan dimseDataChunk),
+		stop:    make(chan struct{}),
+	}
+	sm.stream = stream
+	go func() {
+		size := payload.dataSize
+		for first := true; first || size > 0; first = false {
+			chunk := make([]byte, min(chunkSize, size))
+			var err error
+			if _, err = io.ReadFull(payload.dataReader, chunk); err != nil {
+				err = fmt.Errorf("failed to read DIMSE data: %w", err)
+			}
+			size -= int64(len(chunk))
+			select {
+			case stream.chunkCh <- dimseDataChunk{data: chunk, last: size == 0, err: err}:
+			case <-stream.stop:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// Send a chunk of the data being streamed. Returns the event to run if the
+// stream failed.
+func sendDIMSEStreamChunk(sm *stateMachine, chunk dimseDataChunk) (stateEvent, bool) {
+	if chunk.err != nil {
+		finishDIMSEStream(sm)
+		dicomlog.Vprintf(0, "dicom.stateMachine(%s): %v; aborting", sm.label, chunk.err)
+		sm.reportError(chunk.err)
+		return stateEvent{event: evt15, err: chunk.err}, true
+	}
+	if sm.currentState != sta06 && sm.currentState != sta08 {
+		// The association is going down.
+		finishDIMSEStream(sm)
+		return stateEvent{}, false
+	}
+	err := sendPDU(sm, &pdu.PDataTf{Items: []pdu.PresentationDataValueItem{{
+		ContextID: sm.stream.payload.contextID,
+		Command:   false,
+		Last:      chunk.last,
+		Value:     chunk.data,
+	}}})
+	if err != nil || chunk.last {
+		finishDIMSEStream(sm)
+	}
+	return stateEvent{}, false
+}
+
+// Give up on the stream and the deferred requests to send DIMSE messages, once
+// the association has ended.
+func dropDIMSESends(sm *stateMachine) {
+	finishDIMSEStream(sm)
+	for _, event := range sm.deferredDowncalls {
+		if event.dimsePayload != nil {
+			closeSent(event.dimsePayload)
+		}
+	}
+	sm.deferredDowncalls = nil
+}
+
+// End the stream, sent or not, if any.
+func finishDIMSEStream(sm *stateMachine) {
+	if sm.stream == nil {
+		return
 	}
-	return pdus
+	close(sm.stream.stop)
+	closeSent(sm.stream.payload)
+	sm.stream = nil
+}
+
+// Abort the association after failing to send a DIMSE message.
+func abortOnSendError(sm *stateMachine, event stateEvent, err error) stateType {
+	dicomlog.Vprintf(0, "dicom.stateMachine(%s): %v; aborting", sm.label, err)
+	sm.reportError(err)
+	return actionAa1.Callback(sm, event)
 }
 
 // Data transfer related actions
@@ -293,24 +592,9 @@ var actionDt1 = &stateAction{"DT-1", "Send P-DATA-TF PDU",
 		doassert(event.dimsePayload != nil)
 		command := event.dimsePayload.command
 		doassert(command != nil)
-		e := bytes.Buffer{}
-		err := dimse.EncodeMessage(&e, command)
-		if err != nil {
-			panic(fmt.Sprintf("Failed to encode DIMSE cmd %v: %v", command, err))
-		}
-		dicomlog.Vprintf(1, "dicom.stateMachine(%s): Send DIMSE msg: %v", sm.label, command)
-		pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, true /*command*/, e.Bytes())
-		for _, pdu := range pdus {
-			sendPDU(sm, &pdu)
-		}
-		if command.HasData() {
-			dicomlog.Vprintf(1, "dicom.stateMachine(%s): Send DIMSE data of %db, command: %v", sm.label, len(event.dimsePayload.data), command)
-			pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, false /*data*/, event.dimsePayload.data)
-			for _, pdu := range pdus {
-				sendPDU(sm, &pdu)
-			}
-		} else if len(event.dimsePayload.data) > 0 {
-			panic(fmt.Sprintf("dicom.stateMachine(%s): Found DIMSE data of %db, command: %v", sm.label, len(event.dimsePayload.data), command))
+		dicomlog.Vprintf(1, "dicom.stateMachine(%s): Send DIMSE msg: %v, data %db", sm.label, command, event.dimsePayload.size())
+		if err := sendDIMSEPayload(sm, event.dimsePayload); err != nil {
+			return abortOnSendError(sm, event, err)
 		}
 		return sta06
 	}}
@@ -329,7 +613,9 @@ var actionDt2 = &stateAction{"DT-2", "Send P-DATA indication primitive",
 			}
 			return sta06
 		}
-		dicomlog.Vprintf(0, "dicom.stateMachine(%s): Failed to assemble data: %v", sm.label, err) // TODO(saito)
+		dicomlog.Vprintf(0, "dicom.stateMachine(%s): Failed to assemble data: %v", sm.label, err)
+		sm.commandAssembler.Abort(err)
+		sm.reportError(&ProtocolError{Err: err})
 		return actionAa8.Callback(sm, event)
 	}}
 
@@ -373,24 +659,9 @@ var actionAr6 = &stateAction{"AR-6", "Issue P-DATA indication",
 var actionAr7 = &stateAction{"AR-7", "Issue P-DATA-TF PDU",
 	func(sm *stateMachine, event stateEvent) stateType {
 		doassert(event.dimsePayload != nil)
-		command := event.dimsePayload.command
-		doassert(command != nil)
-		e := bytes.Buffer{}
-		err := dimse.EncodeMessage(&e, command)
-		if err != nil {
-			panic(fmt.Sprintf("dicom.StateMachine %s: Failed to encode DIMSE cmd %v: %v", sm.label, command, err))
-		}
-		pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, true /*command*/, e.Bytes())
-		for _, pdu := range pdus {
-			sendPDU(sm, &pdu)
-		}
-		if command.HasData() {
-			pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, false /*data*/, event.dimsePayload.data)
-			for _, pdu := range pdus {
-				sendPDU(sm, &pdu)
-			}
-		} else {
-			doassert(len(event.dimsePayload.data) == 0)
+		doassert(event.dimsePayload.command != nil)
+		if err := sendDIMSEPayload(sm, event.dimsePayload); err != nil {
+			return abortOnSendError(sm, event, err)
 		}
 		sm.downcallCh <- stateEvent{event: evt14}
 		return sta08
@@ -436,6 +707,9 @@ var actionAa2 = &stateAction{"AA-2", "Stop ARTIM timer if running. Close transpo
 
 var actionAa3 = &stateAction{"AA-3", "If (service-user initiated abort): issue A-ABORT indication and close transport connection, otherwise (service-dul initiated abort): issue A-P-ABORT indication and close transport connection",
 	func(sm *stateMachine, event stateEvent) stateType {
+		if v, ok := event.pdu.(*pdu.AAbort); ok {
+			sm.reportError(&AssociationAbortedError{Source: v.Source, Reason: v.Reason})
+		}
 		sm.closeConnection()
 		return sta01
 	}}
@@ -474,7 +748,11 @@ type upcallEventType int
 const (
 	upcallEventHandshakeCompleted = upcallEventType(100)
 	upcallEventData               = upcallEventType(101)
-	// Note: connection shutdown and any error will result in channel
+	// Sent to the service user when the association fails, e.g., it is
+	// rejected, aborted, or timed out. The channel is closed afterwards, as
+	// usual.
+	upcallEventError = upcallEventType(102)
+	// Note: connection shutdown and any other error will result in channel
 	// closure, so they don't have event types.
 )
 
@@ -485,6 +763,8 @@ func (e *upcallEventType) String() string {
 		description = "Handshake completed"
 	case upcallEventData:
 		description = "P_DATA_TF PDU received"
+	case upcallEventError:
+		description = "Association aborted"
 	default:
 		panic(fmt.Sprintf("dicom.StateMachine: Unknown event type %v", int(*e)))
 	}
@@ -511,11 +791,14 @@ type upcallEvent struct {
 
 	command dimse.Message
 	data    *dimse.DimseCommand
+
+	// Set only in upcallEventError event.
+	err error
 }
 
 type stateEventDIMSEPayload struct {
-	// The syntax UID of the data to be sent.
-	abstractSyntaxName string
+	// The presentation context to send the message on.
+	contextID byte
 
 	// Command to send. len(command) may exceed the max PDU size, in which case it
 	// will be split into multiple PresentationDataValueItems.
@@ -524,6 +807,23 @@ type stateEventDIMSEPayload struct {
 	// Ditto, but for the data payload. The data PDU is sent iff.
 	// command.HasData()==true.
 	data []byte
+
+	// If non-nil, the data payload is read from dataReader as it is sent,
+	// instead of taken from data. dataReader must yield dataSize bytes.
+	dataReader io.Reader
+	dataSize   int64
+
+	// If non-nil, closed once the state machine is done with the message,
+	// whether or not it was sent successfully.
+	sent chan struct{}
+}
+
+// The size of the data payload.
+func (p *stateEventDIMSEPayload) size() int64 {
+	if p.dataReader != nil {
+		return p.dataSize
+	}
+	return int64(len(p.data))
 }
 
 type stateEventDebugInfo struct {
@@ -709,6 +1009,9 @@ type stateMachine struct {
 	// userParams is set only for a client-side statemachine
 	userParams ServiceUserParams
 
+	// providerParams is set only for a server-side statemachine
+	providerParams ServiceProviderParams
+
 	// Manages mappings between one-byte contextID to the
 	// <abstractsyntaxUID, transfersyntaxuid> pair.  Filled during A_ACCEPT
 	// handshake.
@@ -732,6 +1035,12 @@ type stateMachine struct {
 	// For Timer expiration event
 	timerCh chan stateEvent
 
+	// Receives a value when the idle timer may have expired. Nil if
+	// IdleTimeout is not set.
+	idleCh chan struct{}
+	// The last time a PDU was sent or received.
+	lastActivity time.Time
+
 	// The socket to the remote peer.
 	conn         net.Conn
 	currentState stateType
@@ -739,6 +1048,13 @@ type stateMachine struct {
 	// For assembling DIMSE command from multiple P_DATA_TF fragments.
 	commandAssembler dimse.CommandAssembler
 
+	// The DIMSE message whose data is being sent, if any.
+	stream *dimseStream
+	// Requests from the upper layer that arrived during the stream. They
+	// wait for it to end, since the fragments of different messages must
+	// not be interleaved. P3.8 9.3.5.1
+	deferredDowncalls []stateEvent
+
 	// Only for testing.
 	faults FaultInjector
 }
@@ -751,14 +1067,16 @@ func (sm *stateMachine) closeConnection() {
 	}
 }
 
-func sendPDU(sm *stateMachine, v pdu.PDU) {
+// Send "v" to the peer. On failure, the connection is closed, evt17 is queued,
+// and the error is returned.
+func sendPDU(sm *stateMachine, v pdu.PDU) error {
 	doassert(sm.conn != nil)
 	data, err := pdu.EncodePDU(v)
 	if err != nil {
 		dicomlog.Vprintf(0, "dicom.StateMachine %s: Failed to encode: %v; closing connection %v", sm.label, err, sm.conn)
 		sm.conn.Close()
 		sm.errorCh <- stateEvent{event: evt17, err: err}
-		return
+		return err
 	}
 	if sm.faults != nil {
 		action := sm.faults.onSend(data)
@@ -767,27 +1085,97 @@ func sendPDU(sm *stateMachine, v pdu.PDU) {
 			sm.conn.Close()
 		}
 	}
+	sm.lastActivity = time.Now()
 	n, err := sm.conn.Write(data)
 	if n != len(data) || err != nil {
 		dicomlog.Vprintf(0, "dicom.StateMachine %s: Failed to write %d bytes. Actual %d bytes : %v; closing connection %v", sm.label, len(data), n, err, sm.conn)
+		if err == nil {
+			err = io.ErrShortWrite
+		}
 		sm.conn.Close()
 		sm.errorCh <- stateEvent{event: evt17, err: err}
-		return
+		return err
 	}
 	dicomlog.Vprintf(2, "dicom.StateMachine %s: sendPDU: %v", sm.label, v.String())
+	return nil
 }
 
 func (sm *stateMachine) startTimer() {
 	ch := make(chan stateEvent, 1)
 	sm.timerCh = ch
 	currentState := sm.currentState
-	time.AfterFunc(time.Duration(10)*time.Second,
+	time.AfterFunc(sm.artimTimeout(),
 		func() {
 			ch <- stateEvent{event: evt18, debug: &stateEventDebugInfo{currentState}}
 			close(ch)
 		})
 }
 
+// The ARTIM timer used when this side has no setting.
+const defaultARTIMTimeout = 10 * time.Second
+
+func (sm *stateMachine) artimTimeout() time.Duration {
+	timeout := sm.providerParams.ARTIMTimeout
+	if sm.isUser {
+		timeout = sm.userParams.ARTIMTimeout
+	}
+	if timeout <= 0 {
+		timeout = defaultARTIMTimeout
+	}
+	return timeout
+}
+
+func (sm *stateMachine) idleTimeout() time.Duration {
+	if sm.isUser {
+		return sm.userParams.IdleTimeout
+	}
+	return sm.providerParams.IdleTimeout
+}
+
+// Start the idle timer, if IdleTimeout is set.
+func (sm *stateMachine) startIdleTimer() {
+	sm.lastActivity = time.Now()
+	if timeout := sm.idleTimeout(); timeout > 0 {
+		sm.idleCh = make(chan struct{}, 1)
+		sm.scheduleIdleCheck(timeout)
+	}
+}
+
+func (sm *stateMachine) scheduleIdleCheck(d time.Duration) {
+	ch := sm.idleCh
+	time.AfterFunc(d, func() { ch <- struct{}{} })
+}
+
+// Called when the idle timer fires. If the association has been idle for
+// IdleTimeout, it returns an event that aborts the association. Otherwise, it
+// reschedules the timer and returns false.
+func (sm *stateMachine) checkIdle() (stateEvent, bool) {
+	timeout := sm.idleTimeout()
+	idle := time.Since(sm.lastActivity)
+	if idle < timeout {
+		sm.scheduleIdleCheck(timeout - idle)
+		return stateEvent{}, false
+	}
+	if sm.currentState != sta06 {
+		// Not established yet, or being torn down. The ARTIM timer covers
+		// these states.
+		sm.scheduleIdleCheck(timeout)
+		return stateEvent{}, false
+	}
+	err := &TimeoutError{Op: "idle association", Duration: timeout}
+	dicomlog.Vprintf(0, "dicom.StateMachine %s: %v; aborting", sm.label, err)
+	sm.reportError(err)
+	return stateEvent{event: evt15, err: err}, true
+}
+
+// Tell the service user that the association has failed because of "err".
+// Noop on the provider side.
+func (sm *stateMachine) reportError(err error) {
+	if sm.isUser {
+		sm.upcallCh <- upcallEvent{eventType: upcallEventError, err: err}
+	}
+}
+
 func (sm *stateMachine) restartTimer() {
 	sm.startTimer()
 }
@@ -798,7 +1186,6 @@ func (sm *stateMachine) stopTimer() {
 
 func networkReaderThread(ch chan stateEvent, conn net.Conn, maxPDUSize int, smName string) {
 	dicomlog.Vprintf(2, "dicom.StateMachine %s: Starting network reader, maxPDU %d", smName, maxPDUSize)
-	doassert(maxPDUSize > 16*1024)
 	for {
 		v, err := pdu.ReadPDU(conn, maxPDUSize)
 		if err != nil {
@@ -852,20 +1239,44 @@ func (sm *stateMachine) getNextEvent() stateEvent {
 	var ok bool
 	var event stateEvent
 	for event.event == 0 {
+		var chunkCh chan dimseDataChunk
+		if sm.stream != nil {
+			chunkCh = sm.stream.chunkCh
+		} else if len(sm.deferredDowncalls) > 0 {
+			event = sm.deferredDowncalls[0]
+			sm.deferredDowncalls = sm.deferredDowncalls[1:]
+			break
+		}
 		select {
+		case chunk := <-chunkCh:
+			if streamEvent, ok := sendDIMSEStreamChunk(sm, chunk); ok {
+				event = streamEvent
+			}
 		case event, ok = <-sm.netCh:
 			if !ok {
 				sm.netCh = nil
 			}
+			sm.lastActivity = time.Now()
 		case event = <-sm.errorCh:
 			// this channel shall never close.
 		case event, ok = <-sm.timerCh:
 			if !ok {
 				sm.timerCh = nil
+			} else if sm.currentState == sta05 {
+				err := &TimeoutError{Op: "A-ASSOCIATE response", Duration: sm.artimTimeout()}
+				dicomlog.Vprintf(0, "dicom.StateMachine %s: %v; aborting", sm.label, err)
+				sm.reportError(err)
+			}
+		case <-sm.idleCh:
+			if idleEvent, ok := sm.checkIdle(); ok {
+				event = idleEvent
 			}
 		case event, ok = <-sm.downcallCh:
 			if !ok {
 				sm.downcallCh = nil
+			} else if sm.stream != nil && event.event != evt15 {
+				sm.deferredDowncalls = append(sm.deferredDowncalls, event)
+				event = stateEvent{}
 			}
 		}
 	}
@@ -925,24 +1336,30 @@ func runStateMachineForServiceUser(
 		upcallCh:       upcallCh,
 		faults:         getUserFaultInjector(),
 	}
+	sm.startIdleTimer()
 	event := stateEvent{event: evt01}
 	action := findAction(sta01, &event)
 	sm.currentState = action.Callback(sm, event)
 	for sm.currentState != sta01 {
 		sm.runOneStep()
 	}
+	sm.commandAssembler.Abort(errDataSetIncomplete)
+	dropDIMSESends(sm)
 	dicomlog.Vprintf(1, "dicom.StateMachine(%s): statemachine finished", sm.label)
 }
 
 func runStateMachineForServiceProvider(
+	params ServiceProviderParams,
 	conn net.Conn,
 	upcallCh chan upcallEvent,
 	downcallCh chan stateEvent,
-	label string) {
+	label string,
+	spool *dimse.Spool) {
 	sm := &stateMachine{
 		label:          label,
 		isUser:         false,
 		contextManager: newContextManager(label),
+		providerParams: params,
 		conn:           conn,
 		netCh:          make(chan stateEvent, 128),
 		errorCh:        make(chan stateEvent, 128),
@@ -950,11 +1367,19 @@ func runStateMachineForServiceProvider(
 		upcallCh:       upcallCh,
 		faults:         getProviderFaultInjector(),
 	}
+	sm.commandAssembler.Spool = spool
+	sm.commandAssembler.StreamingThreshold = params.StreamingThreshold
+	if sm.commandAssembler.StreamingThreshold == 0 {
+		sm.commandAssembler.StreamingThreshold = DefaultStreamingThreshold
+	}
+	sm.startIdleTimer()
 	event := stateEvent{event: evt05, conn: conn}
 	action := findAction(sta01, &event)
 	sm.currentState = action.Callback(sm, event)
 	for sm.currentState != sta01 {
 		sm.runOneStep()
 	}
+	sm.commandAssembler.Abort(errDataSetIncomplete)
+	dropDIMSESends(sm)
 	dicomlog.Vprintf(1, "dicom.StateMachine %s: statemachine finished", sm.label)
 }
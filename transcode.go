@@ -0,0 +1,270 @@
+package netdicom
+
+// This file implements the conversion of data sets between transfer syntaxes
+// on C-STORE, and the compression of data in DeflatedExplicitVRLittleEndian.
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/algm/go-netdicom/pdu/pdu_item"
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+)
+
+// Report whether "uid" is one of the uncompressed transfer syntaxes, among
+// which data sets can be converted. An empty uid, i.e., a data set without a
+// meta header, counts as uncompressed.
+func isNativeTransferSyntax(uid string) bool {
+	switch uid {
+	case "",
+		dicomuid.ImplicitVRLittleEndian,
+		dicomuid.ExplicitVRLittleEndian,
+		dicomuid.ExplicitVRBigEndian,
+		dicomuid.DeflatedExplicitVRLittleEndian:
+		return true
+	}
+	return false
+}
+
+// Report whether a data set encoded in transfer syntax "from" can be sent in
+// transfer syntax "to".
+func canTranscode(from, to string) bool {
+	return from == to || (isNativeTransferSyntax(from) && isNativeTransferSyntax(to))
+}
+
+// Pick the presentation context to send a data set of sopClassUID encoded in
+// transferSyntaxUID. A context accepted with transferSyntaxUID wins. Failing
+// that, any accepted context whose transfer syntax the data set can be
+// converted to is used.
+func lookupCStoreContext(cm *contextManager, sopClassUID, transferSyntaxUID string) (contextManagerEntry, error) {
+	entry, err := cm.lookupByAbstractSyntaxAndTransferSyntaxUID(sopClassUID, transferSyntaxUID)
+	if err != nil || canTranscode(transferSyntaxUID, entry.transferSyntaxUID) {
+		return entry, err
+	}
+	var accepted []string
+	for _, e := range cm.abstractSyntaxNameToContextIDMap[sopClassUID] {
+		if e.result != pdu_item.PresentationContextAccepted {
+			continue
+		}
+		if canTranscode(transferSyntaxUID, e.transferSyntaxUID) {
+			return *e, nil
+		}
+		accepted = append(accepted, dicomuid.UIDString(e.transferSyntaxUID))
+	}
+	return contextManagerEntry{}, fmt.Errorf("dicom.cstore: cannot convert %s data from transfer syntax %s to the accepted transfer syntax(es) %s",
+		dicomuid.UIDString(sopClassUID), dicomuid.UIDString(transferSyntaxUID), strings.Join(accepted, ", "))
+}
+
+// Encode the elements of "ds", except the meta elements, in transfer syntax
+// "to". "from" is the transfer syntax ds was read in. The two must satisfy
+// canTranscode.
+//
+// Parsed values are re-encoded with the VR and byte order of "to". Elements
+// kept as raw bytes are converted by convertElement. Data in
+// DeflatedExplicitVRLittleEndian is compressed.
+func encodeDataSet(ds *dicom.DataSet, from, to string) ([]byte, error) {
+	fromByteOrder := binary.ByteOrder(binary.LittleEndian)
+	if from != "" {
+		var err error
+		if fromByteOrder, _, err = dicomio.ParseTransferSyntaxUID(from); err != nil {
+			return nil, err
+		}
+	}
+	toByteOrder, _, err := dicomio.ParseTransferSyntaxUID(to)
+	if err != nil {
+		return nil, err
+	}
+	e := dicomio.NewBytesEncoderWithTransferSyntax(to)
+	for _, elem := range ds.Elements {
+		if elem.Tag.Group == dicomtag.MetadataGroup {
+			continue
+		}
+		if from != to {
+			if elem, err = convertElement(elem, ds.Elements, fromByteOrder != toByteOrder); err != nil {
+				return nil, err
+			}
+		}
+		dicom.WriteElement(e, elem)
+	}
+	if err := e.Error(); err != nil {
+		return nil, err
+	}
+	return deflateIfNeeded(e.Bytes(), to)
+}
+
+// Return "elem", or a copy of it converted to be encoded in another transfer
+// syntax. "swap" is set if the byte orders of the two differ. "siblings" are
+// the elements of the data set or item that holds elem.
+//
+// The reader turns the values of most VRs, OW and OF included, into Go values,
+// which the writer encodes in any byte order. Native pixel data, and the
+// values of VRs the reader does not understand, are left as raw bytes; the
+// latter cannot be converted between byte orders.
+func convertElement(elem *dicom.Element, siblings []*dicom.Element, swap bool) (*dicom.Element, error) {
+	switch {
+	case elem.Tag == dicomtag.PixelData:
+		if elem.UndefinedLength {
+			// Encapsulated, which is sent as is.
+			return elem, nil
+		}
+		return convertNativePixelData(elem, siblings, swap)
+	case elem.Tag == dicomtag.Item || elem.VR == "SQ":
+		return convertItems(elem, swap)
+	case swap && (elem.VR == "OL" || elem.VR == "OV" || elem.VR == "UN"):
+		return nil, fmt.Errorf("dicom.cstore: cannot convert %s with VR %s between byte orders",
+			dicomtag.DebugString(elem.Tag), elem.VR)
+	}
+	return elem, nil
+}
+
+// Return a copy of the sequence or item "elem" with its nested elements
+// converted by convertElement.
+func convertItems(elem *dicom.Element, swap bool) (*dicom.Element, error) {
+	var children []*dicom.Element
+	for _, v := range elem.Value {
+		if child, ok := v.(*dicom.Element); ok {
+			children = append(children, child)
+		}
+	}
+	converted := *elem
+	converted.Value = make([]interface{}, len(elem.Value))
+	for i, v := range elem.Value {
+		child, ok := v.(*dicom.Element)
+		if !ok {
+			// Let WriteElement report the problem.
+			converted.Value[i] = v
+			continue
+		}
+		var err error
+		if converted.Value[i], err = convertElement(child, children, swap); err != nil {
+			return nil, err
+		}
+	}
+	return &converted, nil
+}
+
+// Return a copy of the native (not encapsulated) pixel data element "elem"
+// with the VR implied by BitsAllocated, and with its words byte-swapped if
+// "swap". The word size is BitsAllocated, or if "siblings" lack it, implied by
+// the VR. Multiple frames are joined into one value, the layout of native
+// multi-frame data. P3.5 8.1.1, 8.2
+func convertNativePixelData(elem *dicom.Element, siblings []*dicom.Element, swap bool) (*dicom.Element, error) {
+	var image dicom.PixelDataInfo
+	ok := len(elem.Value) == 1
+	if ok {
+		image, ok = elem.Value[0].(dicom.PixelDataInfo)
+	}
+	if !ok {
+		return nil, fmt.Errorf("dicom.cstore: cannot convert pixel data: expect one PixelDataInfo value, but found %v", elem.Value)
+	}
+	bits := uint16(8)
+	if elem.VR == "OW" {
+		bits = 16
+	}
+	for _, sibling := range siblings {
+		if sibling.Tag == dicomtag.BitsAllocated {
+			v, err := sibling.GetUInt16()
+			if err != nil {
+				return nil, fmt.Errorf("dicom.cstore: cannot convert pixel data: %w", err)
+			}
+			bits = v
+		}
+	}
+	converted := *elem
+	converted.VR = "OB"
+	if bits > 8 {
+		converted.VR = "OW"
+	}
+	swap = swap && bits != 8
+	var frame []byte
+	if len(image.Frames) == 1 && !swap {
+		frame = image.Frames[0]
+	} else {
+		// A copy, which leaves the source alone.
+		frame = bytes.Join(image.Frames, nil)
+	}
+	if swap {
+		if (bits != 16 && bits != 32 && bits != 64) || len(frame)%int(bits/8) != 0 {
+			return nil, fmt.Errorf("dicom.cstore: cannot convert %d bytes of pixel data with %d bits allocated between byte orders",
+				len(frame), bits)
+		}
+		swapWords(frame, int(bits/8))
+	}
+	converted.Value = []interface{}{dicom.PixelDataInfo{Offsets: image.Offsets, Frames: [][]byte{frame}}}
+	return &converted, nil
+}
+
+// Reverse the byte order of each "size"-byte word of "data" in place.
+func swapWords(data []byte, size int) {
+	for w := 0; w+size <= len(data); w += size {
+		for i, j := w, w+size-1; i < j; i, j = i+1, j-1 {
+			data[i], data[j] = data[j], data[i]
+		}
+	}
+}
+
+// Compress data for DeflatedExplicitVRLittleEndian, which uses raw deflate,
+// without a zlib header. P3.5 A.5
+func deflateBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Compress "data", which is encoded in transferSyntaxUID, if the transfer
+// syntax calls for it.
+func deflateIfNeeded(data []byte, transferSyntaxUID string) ([]byte, error) {
+	if transferSyntaxUID != dicomuid.DeflatedExplicitVRLittleEndian {
+		return data, nil
+	}
+	return deflateBytes(data)
+}
+
+// Undo deflateIfNeeded. An empty data set stays empty.
+func inflateIfNeeded(data []byte, transferSyntaxUID string) ([]byte, error) {
+	if transferSyntaxUID != dicomuid.DeflatedExplicitVRLittleEndian || len(data) == 0 {
+		return data, nil
+	}
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("dicom: failed to inflate deflated data set: %w", err)
+	}
+	return data, nil
+}
+
+// Return the transfer syntax of data received in transferSyntaxUID once it is
+// inflated. It is what handlers of the data are told.
+func inflatedTransferSyntax(transferSyntaxUID string) string {
+	if transferSyntaxUID == dicomuid.DeflatedExplicitVRLittleEndian {
+		return dicomuid.ExplicitVRLittleEndian
+	}
+	return transferSyntaxUID
+}
+
+// Return the reader and the transfer syntax that a handler of data received in
+// transferSyntaxUID sees. Data in DeflatedExplicitVRLittleEndian is inflated as
+// it is read, and handed over as ExplicitVRLittleEndian.
+func inflateReader(r io.Reader, transferSyntaxUID string) (io.Reader, string) {
+	if transferSyntaxUID != dicomuid.DeflatedExplicitVRLittleEndian || r == nil {
+		return r, transferSyntaxUID
+	}
+	return flate.NewReader(r), inflatedTransferSyntax(transferSyntaxUID)
+}
@@ -0,0 +1,323 @@
+package netdicom
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/algm/go-netdicom/dimse"
+	"github.com/algm/go-netdicom/sopclass"
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/stretchr/testify/require"
+)
+
+// Return the string values of the non-meta elements of "elems".
+func elementStrings(elems []*dicom.Element) []string {
+	var s []string
+	for _, elem := range elems {
+		if elem.Tag.Group != dicomtag.MetadataGroup {
+			s = append(s, elem.String())
+		}
+	}
+	return s
+}
+
+func TestCStoreTranscodes(t *testing.T) {
+	ds := mustReadTestDICOMFile("testdata/reportsi.dcm")
+	for _, transferSyntaxUID := range []string{
+		dicomuid.ImplicitVRLittleEndian,
+		dicomuid.ExplicitVRBigEndian,
+		dicomuid.DeflatedExplicitVRLittleEndian,
+	} {
+		t.Run(dicomuid.UIDString(transferSyntaxUID), func(t *testing.T) {
+			var received []*dicom.Element
+			var receivedTransferSyntaxUID string
+			var receivedSize int64
+			sp := startTestProvider(t, ServiceProviderParams{
+				SupportedTransferSyntaxes: []string{transferSyntaxUID},
+				CStore: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string,
+					dataReader io.Reader, dataSize int64) dimse.Status {
+					receivedTransferSyntaxUID, receivedSize = transferSyntaxUID, dataSize
+					data, err := io.ReadAll(dataReader)
+					if err != nil {
+						return dimse.Status{Status: dimse.CStoreCannotUnderstand}
+					}
+					if received, err = readElementsInBytes(data, transferSyntaxUID); err != nil {
+						return dimse.Status{Status: dimse.CStoreCannotUnderstand}
+					}
+					return dimse.Success
+				},
+			})
+			su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.StorageClasses})
+			require.NoError(t, err)
+			defer su.Release()
+			su.Connect(sp.ListenAddr().String())
+			require.NoError(t, su.CStore(ds))
+			require.Equal(t, elementStrings(ds.Elements), elementStrings(received))
+			if transferSyntaxUID == dicomuid.DeflatedExplicitVRLittleEndian {
+				// Inflated on receipt.
+				require.Equal(t, dicomuid.ExplicitVRLittleEndian, receivedTransferSyntaxUID)
+				require.Equal(t, int64(-1), receivedSize)
+			} else {
+				require.Equal(t, transferSyntaxUID, receivedTransferSyntaxUID)
+			}
+		})
+	}
+}
+
+func TestCStoreCannotTranscode(t *testing.T) {
+	ds := mustReadTestDICOMFile("testdata/IM-0001-0003.dcm")
+	sp := startTestProvider(t, ServiceProviderParams{
+		SupportedTransferSyntaxes: []string{dicomuid.ImplicitVRLittleEndian},
+		CStore:                    testCStoreHandler,
+	})
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.StorageClasses, TransferSyntaxes: testTransferSyntaxes})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+	err = su.CStore(ds)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "cannot convert")
+}
+
+func TestEncodeDataSetSwapsPixelData(t *testing.T) {
+	pixels := []byte{1, 2, 3, 4}
+	ds := &dicom.DataSet{Elements: []*dicom.Element{
+		dicom.MustNewElement(dicomtag.TransferSyntaxUID, dicomuid.ExplicitVRLittleEndian),
+		dicom.MustNewElement(dicomtag.BitsAllocated, uint16(16)),
+		{Tag: dicomtag.PixelData, VR: "OW", Value: []interface{}{dicom.PixelDataInfo{Frames: [][]byte{pixels}}}},
+	}}
+	data, err := encodeDataSet(ds, dicomuid.ExplicitVRLittleEndian, dicomuid.ExplicitVRBigEndian)
+	require.NoError(t, err)
+	// Native pixel data is not parsed, so the bytes are read as they are.
+	d := dicomio.NewBytesDecoderWithTransferSyntax(data, dicomuid.ExplicitVRBigEndian)
+	require.Equal(t, uint16(16), mustGetUInt16(t, dicom.ReadElement(d, dicom.ReadOptions{})))
+	elem := dicom.ReadElement(d, dicom.ReadOptions{})
+	require.NoError(t, d.Finish())
+	require.Equal(t, [][]byte{{2, 1, 4, 3}}, elem.Value[0].(dicom.PixelDataInfo).Frames)
+	// The source is left alone.
+	require.Equal(t, []byte{1, 2, 3, 4}, pixels)
+
+	// Same byte order.
+	data, err = encodeDataSet(ds, dicomuid.ExplicitVRLittleEndian, dicomuid.ImplicitVRLittleEndian)
+	require.NoError(t, err)
+	require.True(t, bytes.HasSuffix(data, pixels))
+}
+
+// Return the raw bytes of the native pixel data encoded in ExplicitVRBigEndian
+// in "data", which starts with BitsAllocated.
+func readBigEndianPixelData(t *testing.T, data []byte) []byte {
+	d := dicomio.NewBytesDecoderWithTransferSyntax(data, dicomuid.ExplicitVRBigEndian)
+	dicom.ReadElement(d, dicom.ReadOptions{})
+	elem := dicom.ReadElement(d, dicom.ReadOptions{})
+	require.NoError(t, d.Finish())
+	frames := elem.Value[0].(dicom.PixelDataInfo).Frames
+	require.Len(t, frames, 1)
+	return frames[0]
+}
+
+func TestEncodeDataSetSwapsPixelDataWords(t *testing.T) {
+	for _, test := range []struct {
+		bits   uint16
+		frames [][]byte
+		want   []byte
+	}{
+		{8, [][]byte{{1, 2, 3, 4}}, []byte{1, 2, 3, 4}},
+		{32, [][]byte{{1, 2, 3, 4, 5, 6, 7, 8}}, []byte{4, 3, 2, 1, 8, 7, 6, 5}},
+		{64, [][]byte{{1, 2, 3, 4, 5, 6, 7, 8}}, []byte{8, 7, 6, 5, 4, 3, 2, 1}},
+		// Multi-frame.
+		{16, [][]byte{{1, 2}, {3, 4}}, []byte{2, 1, 4, 3}},
+		{32, [][]byte{{1, 2, 3, 4}, {5, 6, 7, 8}}, []byte{4, 3, 2, 1, 8, 7, 6, 5}},
+	} {
+		ds := &dicom.DataSet{Elements: []*dicom.Element{
+			dicom.MustNewElement(dicomtag.BitsAllocated, test.bits),
+			{Tag: dicomtag.PixelData, VR: "OW", Value: []interface{}{dicom.PixelDataInfo{Frames: test.frames}}},
+		}}
+		data, err := encodeDataSet(ds, dicomuid.ExplicitVRLittleEndian, dicomuid.ExplicitVRBigEndian)
+		require.NoError(t, err, "bits %d", test.bits)
+		require.Equal(t, test.want, readBigEndianPixelData(t, data), "bits %d", test.bits)
+	}
+	// The source is left alone.
+	frames := [][]byte{{1, 2}, {3, 4}}
+	ds := &dicom.DataSet{Elements: []*dicom.Element{
+		{Tag: dicomtag.PixelData, VR: "OW", Value: []interface{}{dicom.PixelDataInfo{Frames: frames}}},
+	}}
+	_, err := encodeDataSet(ds, dicomuid.ExplicitVRLittleEndian, dicomuid.ExplicitVRBigEndian)
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{{1, 2}, {3, 4}}, frames)
+}
+
+func TestEncodeDataSetSwapsNestedPixelData(t *testing.T) {
+	item := dicom.MustNewElement(dicomtag.Item,
+		dicom.MustNewElement(dicomtag.BitsAllocated, uint16(32)),
+		&dicom.Element{Tag: dicomtag.PixelData, VR: "OW", Value: []interface{}{dicom.PixelDataInfo{Frames: [][]byte{{1, 2, 3, 4}}}}})
+	ds := &dicom.DataSet{Elements: []*dicom.Element{
+		dicom.MustNewElement(dicomtag.BitsAllocated, uint16(16)),
+		dicom.MustNewElement(dicomtag.IconImageSequence, item),
+	}}
+	data, err := encodeDataSet(ds, dicomuid.ExplicitVRLittleEndian, dicomuid.ExplicitVRBigEndian)
+	require.NoError(t, err)
+	// Swapped by the item's BitsAllocated.
+	require.True(t, bytes.HasSuffix(data, []byte{4, 3, 2, 1}))
+}
+
+func TestEncodeDataSetSwapsLUTData(t *testing.T) {
+	lut := make([]byte, 4)
+	dicomio.NativeByteOrder.PutUint16(lut, 0x0102)
+	dicomio.NativeByteOrder.PutUint16(lut[2:], 0x0304)
+	ds := &dicom.DataSet{Elements: []*dicom.Element{
+		{Tag: dicomtag.RedPaletteColorLookupTableData, VR: "OW", Value: []interface{}{lut}},
+	}}
+	data, err := encodeDataSet(ds, dicomuid.ExplicitVRLittleEndian, dicomuid.ExplicitVRBigEndian)
+	require.NoError(t, err)
+	require.True(t, bytes.HasSuffix(data, []byte{1, 2, 3, 4}))
+	data, err = encodeDataSet(ds, dicomuid.ExplicitVRBigEndian, dicomuid.ImplicitVRLittleEndian)
+	require.NoError(t, err)
+	require.True(t, bytes.HasSuffix(data, []byte{2, 1, 4, 3}))
+}
+
+func TestEncodeDataSetCannotSwap(t *testing.T) {
+	for _, elems := range [][]*dicom.Element{
+		// Packed bits.
+		{
+			dicom.MustNewElement(dicomtag.BitsAllocated, uint16(1)),
+			{Tag: dicomtag.PixelData, VR: "OW", Value: []interface{}{dicom.PixelDataInfo{Frames: [][]byte{{1, 2}}}}},
+		},
+		// Not a whole number of words.
+		{
+			dicom.MustNewElement(dicomtag.BitsAllocated, uint16(32)),
+			{Tag: dicomtag.PixelData, VR: "OW", Value: []interface{}{dicom.PixelDataInfo{Frames: [][]byte{{1, 2}}}}},
+		},
+		// Kept as raw bytes by the reader.
+		{{Tag: dicomtag.Tag{Group: 0x0009, Element: 0x1010}, VR: "OL", Value: []interface{}{"\x01\x02\x03\x04"}}},
+		{{Tag: dicomtag.Tag{Group: 0x0009, Element: 0x1011}, VR: "UN", Value: []interface{}{"ab"}}},
+	} {
+		_, err := encodeDataSet(&dicom.DataSet{Elements: elems}, dicomuid.ExplicitVRLittleEndian, dicomuid.ExplicitVRBigEndian)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "cannot convert")
+		// Same byte order.
+		_, err = encodeDataSet(&dicom.DataSet{Elements: elems}, dicomuid.ExplicitVRLittleEndian, dicomuid.ImplicitVRLittleEndian)
+		require.NoError(t, err)
+	}
+}
+
+func TestDeflatedCFind(t *testing.T) {
+	var filterStrings []string
+	sp := startTestProvider(t, ServiceProviderParams{
+		PreferredTransferSyntaxes: []string{dicomuid.DeflatedExplicitVRLittleEndian},
+		CFind: func(ctx context.Context, conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CFindResult) {
+			// Inflated on receipt.
+			if transferSyntaxUID != dicomuid.ExplicitVRLittleEndian {
+				ch <- CFindResult{Err: fmt.Errorf("unexpected transfer syntax %s", transferSyntaxUID)}
+			} else {
+				filterStrings = elementStrings(filters)
+				ch <- CFindResult{Elements: []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "Alice")}}
+			}
+			close(ch)
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.QRFindClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	filter := []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "*")}
+	var results []CFindResult
+	for result := range su.CFind(QRLevelPatient, filter) {
+		results = append(results, result)
+	}
+	// The match, and the final response.
+	require.Len(t, results, 2)
+	require.NoError(t, results[0].Err)
+	require.Equal(t, []string{dicom.MustNewElement(dicomtag.PatientName, "Alice").String()}, elementStrings(results[0].Elements))
+	require.Equal(t, append(elementStrings(filter), dicom.MustNewElement(dicomtag.QueryRetrieveLevel, "PATIENT").String()), filterStrings)
+}
+
+func TestDeflatedCGet(t *testing.T) {
+	ds := mustReadTestDICOMFile("testdata/reportsi.dcm")
+	sp := startTestProvider(t, ServiceProviderParams{
+		PreferredTransferSyntaxes: []string{dicomuid.DeflatedExplicitVRLittleEndian},
+		CGet: func(ctx context.Context, conn ConnectionState, transferSyntaxUID string, sopClassUID string,
+			filters []*dicom.Element, ch chan CMoveResult) {
+			ch <- CMoveResult{Remaining: 0, Path: "reportsi.dcm", DataSet: ds}
+			close(ch)
+		},
+	})
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.QRGetClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(sp.ListenAddr().String())
+
+	var received []*dicom.Element
+	err = su.CGet(QRLevelStudy,
+		[]*dicom.Element{dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3")},
+		func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			if transferSyntaxUID != dicomuid.ExplicitVRLittleEndian {
+				return dimse.Status{Status: dimse.CStoreCannotUnderstand}
+			}
+			var err error
+			if received, err = readElementsInBytes(data, transferSyntaxUID); err != nil {
+				return dimse.Status{Status: dimse.CStoreCannotUnderstand}
+			}
+			return dimse.Success
+		})
+	require.NoError(t, err)
+	require.Equal(t, elementStrings(ds.Elements), elementStrings(received))
+}
+
+func TestCGetCStoreCallbackInflates(t *testing.T) {
+	var called []string
+	cb := func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+		called = append(called, transferSyntaxUID+" "+string(data))
+		return dimse.Success
+	}
+	req := &dimse.CStoreRq{AffectedSOPClassUID: "1.2", AffectedSOPInstanceUID: "1.2.3"}
+	newData := func(payload []byte) *dimse.DimseCommand {
+		data := dimse.NewDimseCommand("")
+		require.NoError(t, data.AppendData(payload))
+		return data
+	}
+
+	deflated, err := deflateBytes([]byte("DICOM"))
+	require.NoError(t, err)
+	status := runCGetCStoreCallback(cb, req, newData(deflated), dicomuid.DeflatedExplicitVRLittleEndian)
+	require.Equal(t, dimse.StatusSuccess, status.Status)
+	require.Equal(t, []string{dicomuid.ExplicitVRLittleEndian + " DICOM"}, called)
+
+	// Not called for data that cannot be inflated.
+	status = runCGetCStoreCallback(cb, req, newData([]byte("not deflated")), dicomuid.DeflatedExplicitVRLittleEndian)
+	require.Equal(t, dimse.CStoreCannotUnderstand, status.Status)
+	require.Len(t, called, 1)
+}
+
+func TestDeflateRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("DICOM"), 1000)
+	deflated, err := deflateIfNeeded(data, dicomuid.DeflatedExplicitVRLittleEndian)
+	require.NoError(t, err)
+	require.Less(t, len(deflated), len(data))
+	// Raw deflate, without a zlib header.
+	inflated, err := io.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+	require.NoError(t, err)
+	require.Equal(t, data, inflated)
+	inflated, err = inflateIfNeeded(deflated, dicomuid.DeflatedExplicitVRLittleEndian)
+	require.NoError(t, err)
+	require.Equal(t, data, inflated)
+
+	same, err := deflateIfNeeded(data, dicomuid.ExplicitVRLittleEndian)
+	require.NoError(t, err)
+	require.Equal(t, data, same)
+	_, err = inflateIfNeeded([]byte("not deflated"), dicomuid.DeflatedExplicitVRLittleEndian)
+	require.Error(t, err)
+}
+
+func mustGetUInt16(t *testing.T, elem *dicom.Element) uint16 {
+	v, err := elem.GetUInt16()
+	require.NoError(t, err)
+	return v
+}